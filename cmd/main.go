@@ -53,23 +53,114 @@ func main() {
 		logrus.Fatalf("Migrations error: %s", err.Error())
 	}
 
-	repo := repository.NewRepository(db)
+	blobs, err := repository.NewBlobStore(repository.BlobStoreConfig{
+		Type: viper.GetString("storage.type"),
+		Local: repository.LocalBlobConfig{
+			Path: viper.GetString("storage.local.path"),
+		},
+		S3: repository.S3BlobConfig{
+			Endpoint:  viper.GetString("storage.s3.endpoint"),
+			Region:    viper.GetString("storage.s3.region"),
+			Bucket:    viper.GetString("storage.s3.bucket"),
+			AccessKey: viper.GetString("storage.s3.accessKey"),
+			SecretKey: viper.GetString("storage.s3.secretKey"),
+		},
+	})
+	if err != nil {
+		logrus.Fatalf("Failed to init blob storage: %s", err.Error())
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-blobs" {
+		moved, err := repository.MigrateBlobs(context.Background(), db, blobs)
+		if err != nil {
+			logrus.Fatalf("Failed to migrate blobs (%d moved): %s", moved, err.Error())
+		}
+		logrus.Infof("Moved %d files to blob storage", moved)
+		return
+	}
+
+	repo := repository.NewRepository(db, blobs)
 	intRedisDB, err := strconv.Atoi(viper.GetString("redis.db"))
 	if err != nil {
 		logrus.Fatal("Invalid value of redis.db")
 	}
-	cache, err := service.NewRedisClient(service.RedisConfig{
-		Host:     viper.GetString("redis.host"),
-		Port:     viper.GetString("redis.port"),
-		Password: viper.GetString("redis.password"),
-		DB:       intRedisDB,
+	cache, err := service.NewCache(service.CacheConfig{
+		Type: viper.GetString("cache.type"),
+		Redis: service.RedisConfig{
+			Host:     viper.GetString("redis.host"),
+			Port:     viper.GetString("redis.port"),
+			Password: viper.GetString("redis.password"),
+			DB:       intRedisDB,
+		},
+		Memory: service.MemoryCacheConfig{
+			MaxEntries: viper.GetInt("cache.memory.maxEntries"),
+			MaxBytes:   viper.GetInt64("cache.memory.maxBytes"),
+			MaxTTL:     viper.GetDuration("cache.memory.maxTTL"),
+		},
+		LocalTTL: viper.GetDuration("cache.localTTL"),
 	})
 	if err != nil {
-		logrus.Fatalf("Failed to connect Redis: %s", err.Error())
+		logrus.Fatalf("Failed to init cache: %s", err.Error())
 	}
 	defer cache.Close()
-	services := service.NewService(repo, viper.GetString("adminToken"), cache)
-	endp := endpoint.NewEndpoint(services)
+	subscriberCtx, stopSubscriber := context.WithCancel(context.Background())
+	defer stopSubscriber()
+	if subscriber, ok := cache.(service.Subscriber); ok {
+		go subscriber.Subscribe(subscriberCtx)
+	}
+	if sweeper, ok := cache.(service.Sweeper); ok {
+		go func() {
+			removed, err := sweeper.Sweep(context.Background(), service.LegacyCacheKeys...)
+			if err != nil {
+				logrus.Errorf("Failed to sweep legacy cache keys: %s", err.Error())
+				return
+			}
+			logrus.Infof("Swept %d legacy cache keys", removed)
+		}()
+	}
+	services, err := service.NewService(repo, service.Config{
+		AdminToken: viper.GetString("adminToken"),
+		Password: service.PasswordConfig{
+			Algorithm: viper.GetString("password.algorithm"),
+			Argon2: service.Argon2Config{
+				Memory:      viper.GetUint32("password.argon2.memory"),
+				Iterations:  viper.GetUint32("password.argon2.iterations"),
+				Parallelism: uint8(viper.GetUint("password.argon2.parallelism")),
+				SaltLength:  viper.GetUint32("password.argon2.saltLength"),
+				KeyLength:   viper.GetUint32("password.argon2.keyLength"),
+			},
+			BcryptCost: viper.GetInt("password.bcrypt.cost"),
+		},
+		Session: service.SessionConfig{
+			AccessTTL:  viper.GetDuration("auth.accessTokenTTL"),
+			RefreshTTL: viper.GetDuration("auth.refreshTokenTTL"),
+		},
+		Cache: service.CachePolicy{
+			ListingTTL:      viper.GetDuration("cache.listingTTL"),
+			DocumentTTL:     viper.GetDuration("cache.documentTTL"),
+			StaleTTL:        viper.GetDuration("cache.staleTTL"),
+			Jitter:          viper.GetFloat64("cache.jitter"),
+			Lock:            viper.GetBool("cache.lock"),
+			LockWait:        viper.GetDuration("cache.lockWait"),
+			LoadTimeout:     viper.GetDuration("cache.loadTimeout"),
+			ContentMaxSize:  viper.GetInt64("cache.contentMaxSize"),
+			ContentMaxBytes: viper.GetInt64("cache.contentMaxBytes"),
+		},
+	}, cache)
+	if err != nil {
+		logrus.Fatalf("Failed to init services: %s", err.Error())
+	}
+	endp := endpoint.NewEndpoint(services, endpoint.Config{
+		TokenCookie:          viper.GetString("auth.tokenCookie"),
+		LegacyTokenLocations: viper.GetBool("auth.legacyTokenLocations"),
+	})
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	janitor := service.NewJanitor(repo, service.JanitorConfig{
+		Enabled:          viper.GetBool("janitor.enabled"),
+		SessionsInterval: viper.GetDuration("janitor.sessionsInterval"),
+		OrphansInterval:  viper.GetDuration("janitor.orphansInterval"),
+		OrphanGrace:      viper.GetDuration("janitor.orphanGrace"),
+	})
+	janitor.Start(janitorCtx)
 	server := &astraltest.Server{}
 	go func() {
 		if err := server.Run(viper.GetString("port"), endp.InitRoutes()); err != nil {
@@ -79,6 +170,8 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
 	<-quit
+	stopJanitor()
+	janitor.Wait()
 	if err := server.Shutdown(context.Background()); err != nil {
 		logrus.Fatalf("server shutdown error: %s", err.Error())
 	}
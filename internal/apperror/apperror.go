@@ -0,0 +1,73 @@
+// Package apperror defines the errors that the repository and service layers
+// return for failures caused by the request rather than by the server. The
+// endpoint layer maps their kinds to HTTP statuses; any other error is an
+// internal one whose details are only logged.
+package apperror
+
+import "errors"
+
+type Kind int
+
+const (
+	Internal Kind = iota
+	NotFound
+	Forbidden
+	Conflict
+	Validation
+	Unauthorized
+)
+
+func (k Kind) String() string {
+	switch k {
+	case NotFound:
+		return "not found"
+	case Forbidden:
+		return "forbidden"
+	case Conflict:
+		return "conflict"
+	case Validation:
+		return "invalid request"
+	case Unauthorized:
+		return "unauthorized"
+	}
+	return "internal error"
+}
+
+// Error is a failure of a known kind. Text is shown to clients, so it must
+// not carry internal details; those belong to Err, which is only logged.
+type Error struct {
+	Kind Kind
+	Text string
+	Err  error
+}
+
+func New(kind Kind, text string) *Error {
+	return &Error{Kind: kind, Text: text}
+}
+
+// Wrap returns an error of the kind caused by err. errors.Is and errors.As
+// still see err.
+func Wrap(kind Kind, text string, err error) *Error {
+	return &Error{Kind: kind, Text: text, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Text
+	}
+	return e.Text + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the kind of the first Error in err's chain, or Internal if
+// there is none.
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Internal
+}
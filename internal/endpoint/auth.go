@@ -2,27 +2,21 @@ package endpoint
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/lavatee/astraltest/internal/model"
-	"github.com/sirupsen/logrus"
 )
 
 func (e *Endpoint) Register(c *gin.Context) {
 	var req model.RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		logrus.Errorf("Failed to register user (invalid request): %s", err.Error())
-		c.JSON(http.StatusBadRequest, model.ErrorResponse{
-			Error: model.ErrorInfo{Code: 400, Text: "Invalid request format"},
-		})
+		fail(c, "register user", invalidRequest("Invalid request format", err))
 		return
 	}
 	login, err := e.services.Auth.Register(c.Request.Context(), req)
 	if err != nil {
-		logrus.Errorf("Failed to register user (internal error): %s", err.Error())
-		c.JSON(http.StatusInternalServerError, model.ErrorResponse{
-			Error: model.ErrorInfo{Code: 500, Text: err.Error()},
-		})
+		fail(c, "register user", err)
 		return
 	}
 	c.JSON(http.StatusOK, model.Response{
@@ -33,35 +27,97 @@ func (e *Endpoint) Register(c *gin.Context) {
 func (e *Endpoint) Authenticate(c *gin.Context) {
 	var req model.AuthRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		logrus.Errorf("Failed to authenticate user (invalid request): %s", err.Error())
-		c.JSON(http.StatusBadRequest, model.ErrorResponse{
-			Error: model.ErrorInfo{Code: 400, Text: "Invalid request format"},
-		})
+		fail(c, "authenticate user", invalidRequest("Invalid request format", err))
 		return
 	}
-	token, err := e.services.Auth.Authenticate(c.Request.Context(), req)
+	tokens, err := e.services.Auth.Authenticate(c.Request.Context(), req, clientInfo(c))
 	if err != nil {
-		logrus.Errorf("Failed to authenticate user (internal error): %s", err.Error())
-		c.JSON(http.StatusUnauthorized, model.ErrorResponse{
-			Error: model.ErrorInfo{Code: 401, Text: "Invalid credentials"},
-		})
+		fail(c, "authenticate user", err)
 		return
 	}
 	c.JSON(http.StatusOK, model.Response{
-		Response: gin.H{"token": token},
+		Response: tokens,
+	})
+}
+
+func (e *Endpoint) Refresh(c *gin.Context) {
+	var req model.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, "refresh token", invalidRequest("Invalid request format", err))
+		return
+	}
+	tokens, err := e.services.Auth.Refresh(c.Request.Context(), req.RefreshToken, clientInfo(c))
+	if err != nil {
+		fail(c, "refresh token", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{
+		Response: tokens,
 	})
 }
 
 func (e *Endpoint) Logout(c *gin.Context) {
 	token := c.Param("token")
-	if err := e.services.Auth.Logout(c.Request.Context(), token); err != nil {
-		logrus.Errorf("Failed to logout user (internal error): %s", err.Error())
-		c.JSON(http.StatusInternalServerError, model.ErrorResponse{
-			Error: model.ErrorInfo{Code: 500, Text: err.Error()},
-		})
+	if err := e.services.Auth.Logout(c.Request.Context(), getPrincipal(c), token); err != nil {
+		fail(c, "logout user", err)
 		return
 	}
 	c.JSON(http.StatusOK, model.Response{
 		Response: gin.H{token: true},
 	})
 }
+
+// clientInfo collects the session metadata shown in the session list.
+func clientInfo(c *gin.Context) model.ClientInfo {
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	return model.ClientInfo{
+		IP:        c.ClientIP(),
+		UserAgent: userAgent,
+	}
+}
+
+func (e *Endpoint) GetSessions(c *gin.Context) {
+	sessions, err := e.services.Auth.GetSessions(c.Request.Context(), getPrincipal(c), c.GetString(tokenCtx))
+	if err != nil {
+		fail(c, "get sessions", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: sessions,
+	})
+}
+
+func (e *Endpoint) RevokeSession(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		fail(c, "revoke session", invalidRequest("Invalid session id", err))
+		return
+	}
+	err = e.services.Auth.RevokeSession(c.Request.Context(), getPrincipal(c), id)
+	if err != nil {
+		fail(c, "revoke session", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{
+		Response: gin.H{"id": id},
+	})
+}
+
+// RevokeSessions logs the user out everywhere. With ?others=true the session
+// making the request stays alive.
+func (e *Endpoint) RevokeSessions(c *gin.Context) {
+	var exceptToken string
+	if others, _ := strconv.ParseBool(c.Query("others")); others {
+		exceptToken = c.GetString(tokenCtx)
+	}
+	if err := e.services.Auth.RevokeSessions(c.Request.Context(), getPrincipal(c), exceptToken); err != nil {
+		fail(c, "revoke sessions", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{
+		Response: gin.H{"revoked": true},
+	})
+}
@@ -1,30 +1,168 @@
 package endpoint
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lavatee/astraltest/internal/apperror"
 	"github.com/lavatee/astraltest/internal/model"
+	"github.com/lavatee/astraltest/internal/service"
 	"github.com/sirupsen/logrus"
 )
 
+// maxFormField limits the meta and json fields of uploads, which are read
+// into memory unlike the file.
+const maxFormField = 32 << 20
+
+var errFormFieldTooLarge = apperror.New(apperror.Validation, "Form field is too large")
+
+// uploadForm holds the fields of an upload. file is the unread file field,
+// or nil if there is none.
+type uploadForm struct {
+	meta     string
+	jsonData string
+	file     io.ReadCloser
+}
+
+// readUploadForm reads the fields of a multipart upload. When the meta field
+// precedes the file of a file document, the file is left unread, so that it
+// streams to the blob store instead of being buffered first. Otherwise the
+// file is spooled to a temporary file and the fields after it are read too.
+// Other forms are parsed as a whole.
+func readUploadForm(c *gin.Context) (*uploadForm, error) {
+	form := &uploadForm{}
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		form.meta, form.jsonData = c.PostForm("meta"), c.PostForm("json")
+		if file, _, err := c.Request.FormFile("file"); err == nil {
+			form.file = file
+		}
+		return form, nil
+	}
+	if err := form.read(reader); err != nil {
+		if form.file != nil {
+			form.file.Close()
+		}
+		return nil, err
+	}
+	return form, nil
+}
+
+func (form *uploadForm) read(reader *multipart.Reader) error {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return invalidRequest("Invalid multipart form", err)
+		}
+		switch part.FormName() {
+		case "file":
+			if form.file != nil {
+				continue
+			}
+			if describesFile(form.meta) {
+				form.file = part
+				return nil
+			}
+			if form.file, err = spool(part); err != nil {
+				return invalidRequest("Invalid multipart form", err)
+			}
+		case "meta", "json":
+			data, err := io.ReadAll(io.LimitReader(part, maxFormField+1))
+			if err != nil {
+				return invalidRequest("Invalid multipart form", err)
+			}
+			if len(data) > maxFormField {
+				return errFormFieldTooLarge
+			}
+			if part.FormName() == "meta" {
+				form.meta = string(data)
+			} else {
+				form.jsonData = string(data)
+			}
+		}
+	}
+}
+
+// describesFile reports whether meta describes a file document, whose body
+// is the file alone.
+func describesFile(meta string) bool {
+	var data model.DocumentMeta
+	return json.Unmarshal([]byte(meta), &data) == nil && data.File
+}
+
+// spool copies the part to a temporary file, which is removed on Close.
+func spool(part io.Reader) (io.ReadCloser, error) {
+	file, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := spooledFile{file}
+	if _, err := io.Copy(file, part); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
+
+type spooledFile struct {
+	*os.File
+}
+
+func (f spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
 func (e *Endpoint) UploadDocument(c *gin.Context) {
-	file, header, err := c.Request.FormFile("file")
-	isFileLoaded := true
+	form, err := readUploadForm(c)
 	if err != nil {
-		isFileLoaded = false
+		fail(c, "upload document", err)
+		return
+	}
+	if form.file != nil {
+		defer form.file.Close()
+	}
+	principal := getPrincipal(c)
+	doc, err := e.services.Documents.Upload(c.Request.Context(), principal, form.meta, form.jsonData, form.file, form.file != nil)
+	if err != nil {
+		fail(c, "upload document", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: doc,
+	})
+}
+
+func (e *Endpoint) UpdateDocument(c *gin.Context) {
+	id := c.Param("id")
+	form, err := readUploadForm(c)
+	if err != nil {
+		fail(c, "update document", err)
+		return
+	}
+	if form.file != nil {
+		defer form.file.Close()
 	}
-	defer file.Close()
-	meta := c.PostForm("meta")
-	jsonData := c.PostForm("json")
-	token := c.GetString("token")
-	doc, err := e.services.Documents.Upload(c.Request.Context(), token, meta, jsonData, file, header, isFileLoaded)
+	principal := getPrincipal(c)
+	doc, err := e.services.Documents.Update(c.Request.Context(), principal, id, form.meta, form.jsonData, form.file, form.file != nil)
 	if err != nil {
-		logrus.Errorf("Failed to upload document (internal error): %s", err.Error())
-		c.JSON(http.StatusInternalServerError, model.ErrorResponse{
-			Error: model.ErrorInfo{Code: 500, Text: err.Error()},
-		})
+		fail(c, "update document", err)
 		return
 	}
 	c.JSON(http.StatusOK, model.DataResponse{
@@ -32,18 +170,25 @@ func (e *Endpoint) UploadDocument(c *gin.Context) {
 	})
 }
 
+// legacyFilterKeys maps column names accepted by the old key/value query
+// parameters to filter fields.
+var legacyFilterKeys = map[string]string{
+	"is_file":    "file",
+	"is_public":  "public",
+	"created_at": "created",
+}
+
 func (e *Endpoint) GetDocuments(c *gin.Context) {
-	token := c.GetString("token")
-	login := c.Query("login")
-	key := c.Query("key")
-	value := c.Query("value")
-	limit, _ := strconv.Atoi(c.Query("limit"))
-	docs, err := e.services.Documents.GetAll(c.Request.Context(), token, login, key, value, limit)
+	principal := getPrincipal(c)
+	query, err := parseDocumentQuery(c)
+	if err != nil {
+		// Parse errors only describe the query, so the client sees them.
+		fail(c, "get documents", apperror.New(apperror.Validation, err.Error()))
+		return
+	}
+	page, err := e.services.Documents.GetAll(c.Request.Context(), principal, query)
 	if err != nil {
-		logrus.Errorf("Failed to get documents (internal error): %s", err.Error())
-		c.JSON(http.StatusInternalServerError, model.ErrorResponse{
-			Error: model.ErrorInfo{Code: 500, Text: err.Error()},
-		})
+		fail(c, "get documents", err)
 		return
 	}
 	if c.Request.Method == http.MethodHead {
@@ -51,46 +196,173 @@ func (e *Endpoint) GetDocuments(c *gin.Context) {
 		return
 	}
 	c.JSON(http.StatusOK, model.DataResponse{
-		Data: gin.H{"docs": docs},
+		Data: page,
 	})
 }
 
+func parseDocumentQuery(c *gin.Context) (model.DocumentQuery, error) {
+	query := model.DocumentQuery{Login: c.Query("login")}
+	var err error
+	if query.Filter, err = service.ParseFilter(c.Query("filter")); err != nil {
+		return query, err
+	}
+	if c.Query("key") != "" && c.Query("value") != "" {
+		key := c.Query("key")
+		if field, ok := legacyFilterKeys[key]; ok {
+			key = field
+		}
+		cond, err := service.NewFilterCondition(key, model.OpEq, c.Query("value"))
+		if err != nil {
+			return query, err
+		}
+		query.Filter = append(query.Filter, cond)
+	}
+	if query.Sort, err = service.ParseSort(c.Query("sort")); err != nil {
+		return query, err
+	}
+	if query.Cursor, err = service.ParseCursor(c.Query("cursor"), query.Sort); err != nil {
+		return query, err
+	}
+	if limit := c.Query("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return query, errors.New("invalid limit")
+		}
+	}
+	if total := c.Query("total"); total != "" {
+		if query.Total, err = strconv.ParseBool(total); err != nil {
+			return query, errors.New("invalid total")
+		}
+	}
+	return query, nil
+}
+
 func (e *Endpoint) GetDocument(c *gin.Context) {
 	id := c.Param("id")
-	token := c.GetString("token")
-	doc, fileData, err := e.services.Documents.GetByID(c.Request.Context(), token, id)
+	principal := getPrincipal(c)
+	doc, body, err := e.services.Documents.GetByID(c.Request.Context(), principal, id)
 	if err != nil {
-		logrus.Errorf("Failed to get document (internal error): %s", err.Error())
-		c.JSON(http.StatusInternalServerError, model.ErrorResponse{
-			Error: model.ErrorInfo{Code: 500, Text: err.Error()},
-		})
+		fail(c, "get document", err)
+		return
+	}
+	defer body.Close()
+	writeBody(c, doc.File, doc.Mime, doc.Hash, doc.Updated, doc.Size, body)
+}
+
+// Downloads of files get minDownloadTime plus the time to send them at
+// minDownloadRate, up to maxDownloadTime, so that a client that reads slowly
+// or not at all does not hold the connection forever.
+const (
+	minDownloadRate = 64 << 10
+	minDownloadTime = 30 * time.Second
+	maxDownloadTime = time.Hour
+)
+
+func downloadTimeout(size int64) time.Duration {
+	seconds := size / minDownloadRate
+	if seconds >= int64(maxDownloadTime/time.Second) {
+		return maxDownloadTime
+	}
+	return min(minDownloadTime+time.Duration(seconds)*time.Second, maxDownloadTime)
+}
+
+// writeBody serves a document body with validators, so clients can resume
+// downloads with Range and revalidate caches with If-None-Match and
+// If-Modified-Since. JSON documents are wrapped into DataResponse first.
+func writeBody(c *gin.Context, isFile bool, mime, hash string, modified time.Time, size int64, body io.Reader) {
+	if hash != "" {
+		c.Header("ETag", `"`+hash+`"`)
+	}
+	if !isFile {
+		data, err := io.ReadAll(body)
+		if err == nil {
+			data, err = json.Marshal(model.DataResponse{Data: string(data)})
+		}
+		if err != nil {
+			fail(c, "read document", err)
+			return
+		}
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		http.ServeContent(c.Writer, c.Request, "", modified, bytes.NewReader(data))
+		return
+	}
+	// Large files take longer than the server write timeout to send.
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(downloadTimeout(size)))
+	if mime == "" {
+		mime = "application/octet-stream"
+	}
+	c.Header("Content-Type", mime)
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, "", modified, seeker)
 		return
 	}
+	c.Status(http.StatusOK)
 	if c.Request.Method == http.MethodHead {
-		c.Status(http.StatusOK)
 		return
 	}
-	if doc.File {
-		c.Data(http.StatusOK, doc.Mime, fileData)
-	} else {
-		c.JSON(http.StatusOK, model.DataResponse{
-			Data: string(fileData),
-		})
+	if _, err := io.Copy(c.Writer, body); err != nil {
+		logrus.Errorf("Failed to send document: %s", err.Error())
 	}
 }
 
 func (e *Endpoint) DeleteDocument(c *gin.Context) {
 	id := c.Param("id")
-	token := c.GetString("token")
-	err := e.services.Documents.Delete(c.Request.Context(), token, id)
+	principal := getPrincipal(c)
+	err := e.services.Documents.Delete(c.Request.Context(), principal, id)
 	if err != nil {
-		logrus.Errorf("Failed to delete document (internal error): %s", err.Error())
-		c.JSON(http.StatusInternalServerError, model.ErrorResponse{
-			Error: model.ErrorInfo{Code: 500, Text: err.Error()},
-		})
+		fail(c, "delete document", err)
 		return
 	}
 	c.JSON(http.StatusOK, model.Response{
 		Response: gin.H{id: true},
 	})
 }
+
+func (e *Endpoint) PatchDocument(c *gin.Context) {
+	var patch model.DocumentPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		fail(c, "patch document", invalidRequest("Invalid request format", err))
+		return
+	}
+	doc, err := e.services.Documents.Patch(c.Request.Context(), getPrincipal(c), c.Param("id"), patch)
+	if err != nil {
+		fail(c, "patch document", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: doc,
+	})
+}
+
+func (e *Endpoint) AddGrant(c *gin.Context) {
+	var req model.GrantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, "add grant", invalidRequest("Invalid request format", err))
+		return
+	}
+	doc, err := e.services.Documents.AddGrant(c.Request.Context(), getPrincipal(c), c.Param("id"), req)
+	if err != nil {
+		fail(c, "add grant", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: doc,
+	})
+}
+
+// RevokeGrant takes the user or group from the login or group query
+// parameter.
+func (e *Endpoint) RevokeGrant(c *gin.Context) {
+	var req model.GrantRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		fail(c, "revoke grant", invalidRequest("Invalid request format", err))
+		return
+	}
+	doc, err := e.services.Documents.RevokeGrant(c.Request.Context(), getPrincipal(c), c.Param("id"), req)
+	if err != nil {
+		fail(c, "revoke grant", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: doc,
+	})
+}
@@ -4,17 +4,31 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lavatee/astraltest/internal/model"
 	"github.com/lavatee/astraltest/internal/service"
 )
 
+type Config struct {
+	// TokenCookie is the name of the cookie that may carry the token.
+	TokenCookie string
+	// LegacyTokenLocations enables tokens in the query string, JSON bodies
+	// and upload meta. Tokens in URLs end up in access logs.
+	LegacyTokenLocations bool
+}
+
 type Endpoint struct {
-	services *service.Service
+	services   *service.Service
+	config     Config
+	extractors []tokenExtractor
 }
 
-func NewEndpoint(services *service.Service) *Endpoint {
-	return &Endpoint{
+func NewEndpoint(services *service.Service, config Config) *Endpoint {
+	e := &Endpoint{
 		services: services,
+		config:   config,
 	}
+	e.extractors = e.tokenExtractors()
+	return e
 }
 
 func (e *Endpoint) InitRoutes() *gin.Engine {
@@ -22,25 +36,58 @@ func (e *Endpoint) InitRoutes() *gin.Engine {
 	router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, PATCH, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "X-Auth-Token, Content-Type, Origin, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "X-Auth-Token, Content-Type, Origin, Authorization, Range, If-Range, If-None-Match, If-Modified-Since")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Content-Range, Content-Length, Accept-Ranges")
 		c.Writer.Header().Set("Access-Control-Allow-Creditionals", "true")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusOK)
 			return
 		}
 	})
+	router.Use(e.ErrorHandler)
 	public := router.Group("/api")
 	{
 		public.POST("/register", e.Register)
 		public.POST("/auth", e.Authenticate)
+		public.POST("/auth/refresh", e.Refresh)
 	}
 	protected := router.Group("/api", e.Middleware)
 	{
-		protected.POST("/docs", e.UploadDocument)
-		protected.GET("/docs", e.GetDocuments)
-		protected.GET("/docs/:id", e.GetDocument)
-		protected.DELETE("/docs/:id", e.DeleteDocument)
+		read := e.RequirePermission(model.PermDocsRead)
+		write := e.RequirePermission(model.PermDocsWrite)
+		protected.POST("/docs", write, e.UploadDocument)
+		protected.GET("/docs", read, e.GetDocuments)
+		protected.HEAD("/docs", read, e.GetDocuments)
+		protected.GET("/docs/:id", read, e.GetDocument)
+		protected.HEAD("/docs/:id", read, e.GetDocument)
+		protected.PUT("/docs/:id", write, e.UpdateDocument)
+		protected.PATCH("/docs/:id", write, e.PatchDocument)
+		protected.DELETE("/docs/:id", write, e.DeleteDocument)
+		protected.GET("/docs/:id/versions", read, e.GetVersions)
+		protected.GET("/docs/:id/versions/:n", read, e.GetVersion)
+		protected.POST("/docs/:id/versions/:n/restore", write, e.RestoreVersion)
+		protected.GET("/docs/:id/diff", read, e.DiffVersions)
+		protected.POST("/docs/:id/grants", write, e.AddGrant)
+		protected.DELETE("/docs/:id/grants", write, e.RevokeGrant)
+		protected.GET("/auth/sessions", e.GetSessions)
+		protected.DELETE("/auth/sessions", e.RevokeSessions)
+		protected.DELETE("/auth/sessions/:id", e.RevokeSession)
 		protected.DELETE("/auth/:token", e.Logout)
+		protected.POST("/users/me/password", e.ChangePassword)
+		protected.GET("/groups", read, e.GetGroups)
+		protected.GET("/groups/:name", read, e.GetGroup)
+	}
+	admin := protected.Group("", e.RequirePermission(model.PermUsersManage))
+	{
+		admin.GET("/users", e.GetUsers)
+		admin.GET("/users/:login", e.GetUser)
+		admin.PATCH("/users/:login", e.UpdateUser)
+		admin.DELETE("/users/:login", e.DeleteUser)
+		admin.PUT("/users/:login/roles", e.SetRoles)
+		admin.POST("/groups", e.CreateGroup)
+		admin.DELETE("/groups/:name", e.DeleteGroup)
+		admin.PUT("/groups/:name/members/:login", e.AddGroupMember)
+		admin.DELETE("/groups/:name/members/:login", e.RemoveGroupMember)
 	}
 	return router
 }
@@ -0,0 +1,58 @@
+package endpoint
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lavatee/astraltest/internal/apperror"
+	"github.com/lavatee/astraltest/internal/model"
+	"github.com/sirupsen/logrus"
+)
+
+var statuses = map[apperror.Kind]int{
+	apperror.Internal:     http.StatusInternalServerError,
+	apperror.NotFound:     http.StatusNotFound,
+	apperror.Forbidden:    http.StatusForbidden,
+	apperror.Conflict:     http.StatusConflict,
+	apperror.Validation:   http.StatusBadRequest,
+	apperror.Unauthorized: http.StatusUnauthorized,
+}
+
+// fail hands the error of a handler or middleware over to ErrorHandler and
+// stops the request. The action completes the "Failed to" log message.
+func fail(c *gin.Context, action string, err error) {
+	c.Error(err).SetMeta(action)
+	c.Abort()
+}
+
+// invalidRequest reports a request that could not be parsed. The cause is
+// logged, the client gets the text.
+func invalidRequest(text string, err error) error {
+	return apperror.Wrap(apperror.Validation, text, err)
+}
+
+// ErrorHandler answers requests that failed. Errors of a known kind are
+// reported with their status and text; anything else is an internal error
+// whose details only go to the log.
+func (e *Endpoint) ErrorHandler(c *gin.Context) {
+	c.Next()
+	last := c.Errors.Last()
+	if last == nil {
+		return
+	}
+	kind, text := apperror.Internal, "Internal server error"
+	var appErr *apperror.Error
+	if errors.As(last.Err, &appErr) && appErr.Kind != apperror.Internal {
+		kind, text = appErr.Kind, appErr.Text
+	}
+	action, _ := last.Meta.(string)
+	logrus.Errorf("Failed to %s (%s): %s", action, kind, last.Err.Error())
+	if c.Writer.Written() {
+		return
+	}
+	status := statuses[kind]
+	c.JSON(status, model.ErrorResponse{
+		Error: model.ErrorInfo{Code: status, Text: text},
+	})
+}
@@ -0,0 +1,79 @@
+package endpoint
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lavatee/astraltest/internal/model"
+)
+
+func (e *Endpoint) GetGroups(c *gin.Context) {
+	groups, err := e.services.Groups.GetGroups(c.Request.Context(), getPrincipal(c))
+	if err != nil {
+		fail(c, "get groups", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: groups,
+	})
+}
+
+func (e *Endpoint) GetGroup(c *gin.Context) {
+	group, err := e.services.Groups.GetGroup(c.Request.Context(), getPrincipal(c), c.Param("name"))
+	if err != nil {
+		fail(c, "get group", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: group,
+	})
+}
+
+func (e *Endpoint) CreateGroup(c *gin.Context) {
+	var req model.GroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, "create group", invalidRequest("Invalid request format", err))
+		return
+	}
+	group, err := e.services.Groups.CreateGroup(c.Request.Context(), getPrincipal(c), req)
+	if err != nil {
+		fail(c, "create group", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: group,
+	})
+}
+
+func (e *Endpoint) DeleteGroup(c *gin.Context) {
+	name := c.Param("name")
+	if err := e.services.Groups.DeleteGroup(c.Request.Context(), getPrincipal(c), name); err != nil {
+		fail(c, "delete group", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{
+		Response: gin.H{name: true},
+	})
+}
+
+func (e *Endpoint) AddGroupMember(c *gin.Context) {
+	login := c.Param("login")
+	if err := e.services.Groups.AddGroupMember(c.Request.Context(), getPrincipal(c), c.Param("name"), login); err != nil {
+		fail(c, "add group member", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{
+		Response: gin.H{login: true},
+	})
+}
+
+func (e *Endpoint) RemoveGroupMember(c *gin.Context) {
+	login := c.Param("login")
+	if err := e.services.Groups.RemoveGroupMember(c.Request.Context(), getPrincipal(c), c.Param("name"), login); err != nil {
+		fail(c, "remove group member", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{
+		Response: gin.H{login: true},
+	})
+}
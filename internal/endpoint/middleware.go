@@ -1,53 +1,173 @@
 package endpoint
 
 import (
+	"bytes"
 	"encoding/json"
-	"net/http"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lavatee/astraltest/internal/apperror"
 	"github.com/lavatee/astraltest/internal/model"
-	"github.com/sirupsen/logrus"
+	"github.com/lavatee/astraltest/internal/service"
 )
 
+const (
+	tokenCtx     = "token"
+	userIDCtx    = "userID"
+	loginCtx     = "login"
+	principalCtx = "principal"
+	rolesCtx     = "roles"
+)
+
+var errTokenRequired = apperror.New(apperror.Unauthorized, "Authorization token required")
+
 type BodyWithToken struct {
 	Token string `json:"token" binding:"required"`
 }
 
-func (e *Endpoint) Middleware(c *gin.Context) {
-	var token string
+// tokenExtractor returns the token found in one place of the request or an
+// empty string.
+type tokenExtractor func(c *gin.Context) string
+
+func (e *Endpoint) tokenExtractors() []tokenExtractor {
+	extractors := []tokenExtractor{
+		bearerToken,
+		func(c *gin.Context) string { return c.GetHeader("X-Auth-Token") },
+	}
+	if e.config.TokenCookie != "" {
+		extractors = append(extractors, func(c *gin.Context) string {
+			token, _ := c.Cookie(e.config.TokenCookie)
+			return token
+		})
+	}
+	if e.config.LegacyTokenLocations {
+		extractors = append(extractors, legacyToken)
+	}
+	return extractors
+}
+
+func bearerToken(c *gin.Context) string {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// maxLegacyBody limits what legacyToken reads of a body. It runs before
+// authentication, so anyone could make the server buffer whole bodies
+// otherwise.
+const maxLegacyBody = 1 << 20
+
+// legacyToken looks for the token where the first clients sent it: the query
+// string, a JSON body and the meta field of a multipart upload. It is the
+// last extractor, so bodies are only read when the headers, the cookie and
+// the query string have no token. What is read is put back for handlers.
+func legacyToken(c *gin.Context) string {
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+	if c.Request.Body == nil {
+		return ""
+	}
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		return multipartToken(c)
+	}
+	if c.ContentType() != "application/json" {
+		return ""
+	}
+	original := c.Request.Body
+	body, err := io.ReadAll(io.LimitReader(original, maxLegacyBody+1))
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), original), original}
+	if err != nil || len(body) > maxLegacyBody {
+		return ""
+	}
 	var req BodyWithToken
-	var metaData model.DocumentMeta
-	meta := c.PostForm("meta")
-	if err := json.Unmarshal([]byte(meta), &metaData); err == nil {
-		token = metaData.Token
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ""
 	}
-	if err := c.ShouldBindJSON(&req); err == nil {
-		token = req.Token
+	return req.Token
+}
+
+// multipartToken reads an upload up to its meta field, giving up at the file
+// or after maxLegacyBody bytes. The bytes read are put in front of the rest
+// of the body, so that the handler still streams the file.
+func multipartToken(c *gin.Context) string {
+	_, params, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return ""
 	}
-	if c.Query("token") != "" {
-		token = c.Query("token")
+	body := c.Request.Body
+	var read bytes.Buffer
+	defer func() {
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&read, body), body}
+	}()
+	reader := multipart.NewReader(io.TeeReader(io.LimitReader(body, maxLegacyBody), &read), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil || part.FormName() == "file" || part.FileName() != "" {
+			return ""
+		}
+		if part.FormName() != "meta" {
+			continue
+		}
+		var metaData model.DocumentMeta
+		if err := json.NewDecoder(part).Decode(&metaData); err != nil {
+			return ""
+		}
+		return metaData.Token
+	}
+}
+
+func (e *Endpoint) Middleware(c *gin.Context) {
+	var token string
+	for _, extract := range e.extractors {
+		if token = extract(c); token != "" {
+			break
+		}
 	}
 	if token == "" {
-		logrus.Error("Middleware error: token required")
-		c.AbortWithStatusJSON(http.StatusUnauthorized, model.ErrorResponse{
-			Error: model.ErrorInfo{
-				Text: "Authorization token required",
-				Code: 401,
-			},
-		})
+		fail(c, "authenticate request", errTokenRequired)
 		return
 	}
-	valid, err := e.services.Auth.ValidateToken(c.Request.Context(), token)
-	if err != nil || !valid {
-		logrus.Error("Middleware error: token is invalid")
-		c.AbortWithStatusJSON(http.StatusUnauthorized, model.ErrorResponse{
-			Error: model.ErrorInfo{
-				Text: "Invalid token",
-				Code: 401,
-			},
-		})
+	principal, err := e.services.Auth.ValidateToken(c.Request.Context(), token)
+	if err != nil {
+		fail(c, "authenticate request", err)
 		return
 	}
-	c.Set("token", token)
+	c.Set(tokenCtx, token)
+	c.Set(userIDCtx, principal.UserID)
+	c.Set(loginCtx, principal.Login)
+	c.Set(rolesCtx, principal.Roles)
+	c.Set(principalCtx, principal)
 	c.Next()
 }
+
+// RequirePermission rejects requests of principals whose roles do not grant
+// the permission. It must run after Middleware.
+func (e *Endpoint) RequirePermission(perm model.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !getPrincipal(c).Can(perm) {
+			err := fmt.Errorf("%w: %s required, roles: %v", service.ErrForbidden, perm, c.GetStringSlice(rolesCtx))
+			fail(c, "authorize request", err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// getPrincipal returns the principal stored by Middleware.
+func getPrincipal(c *gin.Context) *model.Principal {
+	principal, _ := c.MustGet(principalCtx).(*model.Principal)
+	return principal
+}
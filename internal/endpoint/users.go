@@ -0,0 +1,94 @@
+package endpoint
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lavatee/astraltest/internal/model"
+)
+
+func (e *Endpoint) GetUsers(c *gin.Context) {
+	users, err := e.services.Users.GetUsers(c.Request.Context(), getPrincipal(c))
+	if err != nil {
+		fail(c, "get users", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: users,
+	})
+}
+
+func (e *Endpoint) GetUser(c *gin.Context) {
+	user, err := e.services.Users.GetUser(c.Request.Context(), getPrincipal(c), c.Param("login"))
+	if err != nil {
+		fail(c, "get user", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: user,
+	})
+}
+
+func (e *Endpoint) UpdateUser(c *gin.Context) {
+	var patch model.UserPatch
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		fail(c, "update user", invalidRequest("Invalid request format", err))
+		return
+	}
+	user, err := e.services.Users.UpdateUser(c.Request.Context(), getPrincipal(c), c.Param("login"), patch)
+	if err != nil {
+		fail(c, "update user", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: user,
+	})
+}
+
+// DeleteUser expects ?documents=delete or ?documents=transfer&to=<login>.
+func (e *Endpoint) DeleteUser(c *gin.Context) {
+	login := c.Param("login")
+	deletion := model.UserDeletion{
+		Documents:  c.Query("documents"),
+		TransferTo: c.Query("to"),
+	}
+	if err := e.services.Users.DeleteUser(c.Request.Context(), getPrincipal(c), login, deletion); err != nil {
+		fail(c, "delete user", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{
+		Response: gin.H{login: true},
+	})
+}
+
+func (e *Endpoint) SetRoles(c *gin.Context) {
+	var req model.RolesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, "set user roles", invalidRequest("Invalid request format", err))
+		return
+	}
+	user, err := e.services.Users.SetRoles(c.Request.Context(), getPrincipal(c), c.Param("login"), req.Roles)
+	if err != nil {
+		fail(c, "set user roles", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{
+		Response: gin.H{"login": user.Login, "roles": user.Roles},
+	})
+}
+
+func (e *Endpoint) ChangePassword(c *gin.Context) {
+	var req model.PasswordChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		fail(c, "change password", invalidRequest("Invalid request format", err))
+		return
+	}
+	err := e.services.Auth.ChangePassword(c.Request.Context(), getPrincipal(c), c.GetString(tokenCtx), req)
+	if err != nil {
+		fail(c, "change password", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.Response{
+		Response: gin.H{"changed": true},
+	})
+}
@@ -0,0 +1,77 @@
+package endpoint
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lavatee/astraltest/internal/model"
+)
+
+func (e *Endpoint) GetVersions(c *gin.Context) {
+	id := c.Param("id")
+	principal := getPrincipal(c)
+	versions, err := e.services.Documents.GetVersions(c.Request.Context(), principal, id)
+	if err != nil {
+		fail(c, "get document versions", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: gin.H{"versions": versions},
+	})
+}
+
+func (e *Endpoint) GetVersion(c *gin.Context) {
+	id := c.Param("id")
+	principal := getPrincipal(c)
+	version, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		fail(c, "get document version", invalidRequest("Invalid version", err))
+		return
+	}
+	ver, body, err := e.services.Documents.GetVersion(c.Request.Context(), principal, id, version)
+	if err != nil {
+		fail(c, "get document version", err)
+		return
+	}
+	defer body.Close()
+	writeBody(c, ver.File, ver.Mime, ver.Hash, ver.Created, ver.Size, body)
+}
+
+func (e *Endpoint) RestoreVersion(c *gin.Context) {
+	id := c.Param("id")
+	principal := getPrincipal(c)
+	version, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		fail(c, "restore document version", invalidRequest("Invalid version", err))
+		return
+	}
+	doc, err := e.services.Documents.RestoreVersion(c.Request.Context(), principal, id, version)
+	if err != nil {
+		fail(c, "restore document version", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: doc,
+	})
+}
+
+func (e *Endpoint) DiffVersions(c *gin.Context) {
+	id := c.Param("id")
+	principal := getPrincipal(c)
+	from, fromErr := strconv.Atoi(c.Query("from"))
+	to, toErr := strconv.Atoi(c.Query("to"))
+	if fromErr != nil || toErr != nil {
+		fail(c, "diff document versions", invalidRequest("Invalid version", errors.Join(fromErr, toErr)))
+		return
+	}
+	diff, err := e.services.Documents.Diff(c.Request.Context(), principal, id, from, to)
+	if err != nil {
+		fail(c, "diff document versions", err)
+		return
+	}
+	c.JSON(http.StatusOK, model.DataResponse{
+		Data: diff,
+	})
+}
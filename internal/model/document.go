@@ -5,20 +5,112 @@ import (
 )
 
 type Document struct {
-	ID      string    `json:"id" db:"id"`
+	ID      string      `json:"id" db:"id"`
+	Name    string      `json:"name" db:"name"`
+	Mime    string      `json:"mime,omitempty" db:"mime"`
+	File    bool        `json:"file" db:"is_file"`
+	Public  bool        `json:"public" db:"is_public"`
+	Created time.Time   `json:"created" db:"created_at"`
+	Updated time.Time   `json:"updated" db:"updated_at"`
+	Version int         `json:"version" db:"version"`
+	Size    int64       `json:"size" db:"size"`
+	Hash    string      `json:"hash,omitempty" db:"hash"`
+	Grant   []UserGrant `json:"grant,omitempty"`
+	// GrantGroups share the document with every member of the groups.
+	GrantGroups []GroupGrant `json:"grant_groups,omitempty"`
+}
+
+// FieldValue returns the value of a filter field, see DocumentFilterFields.
+func (d *Document) FieldValue(field string) interface{} {
+	switch field {
+	case "id":
+		return d.ID
+	case "name":
+		return d.Name
+	case "mime":
+		return d.Mime
+	case "file":
+		return d.File
+	case "public":
+		return d.Public
+	case "created":
+		return d.Created
+	case "updated":
+		return d.Updated
+	case "version":
+		return int64(d.Version)
+	case "size":
+		return d.Size
+	}
+	return nil
+}
+
+type DocumentMeta struct {
+	Name        string       `json:"name"`
+	File        bool         `json:"file"`
+	Public      bool         `json:"public"`
+	Token       string       `json:"token"`
+	Mime        string       `json:"mime,omitempty"`
+	Grant       []UserGrant  `json:"grant,omitempty"`
+	GrantGroups []GroupGrant `json:"grant_groups,omitempty"`
+}
+
+// DocumentACL lists who can read a document, for access checks that do not
+// need the database.
+type DocumentACL struct {
+	OwnerID int   `json:"owner_id" db:"owner_id"`
+	Public  bool  `json:"public" db:"is_public"`
+	Users   []int `json:"users"`
+	Groups  []int `json:"groups"`
+}
+
+// Allows reports whether the user, a member of the groups, can read the
+// document.
+func (a *DocumentACL) Allows(userID int, groups []int) bool {
+	if a.Public || a.OwnerID == userID {
+		return true
+	}
+	for _, id := range a.Users {
+		if id == userID {
+			return true
+		}
+	}
+	for _, group := range a.Groups {
+		for _, id := range groups {
+			if id == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DocumentPatch changes the metadata of a document without creating a new
+// version. Fields left out of the request are not changed.
+type DocumentPatch struct {
+	Name   *string `json:"name"`
+	Mime   *string `json:"mime"`
+	Public *bool   `json:"public"`
+}
+
+type DocumentVersion struct {
+	Version int       `json:"version" db:"version"`
 	Name    string    `json:"name" db:"name"`
 	Mime    string    `json:"mime,omitempty" db:"mime"`
 	File    bool      `json:"file" db:"is_file"`
-	Public  bool      `json:"public" db:"is_public"`
 	Created time.Time `json:"created" db:"created_at"`
-	Grant   []string  `json:"grant,omitempty"`
+	Size    int64     `json:"size" db:"size"`
+	Hash    string    `json:"hash,omitempty" db:"hash"`
 }
 
-type DocumentMeta struct {
-	Name   string   `json:"name"`
-	File   bool     `json:"file"`
-	Public bool     `json:"public"`
-	Token  string   `json:"token"`
-	Mime   string   `json:"mime,omitempty"`
-	Grant  []string `json:"grant,omitempty"`
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+type DocumentDiff struct {
+	From    int        `json:"from"`
+	To      int        `json:"to"`
+	Changed bool       `json:"changed"`
+	Lines   []DiffLine `json:"lines,omitempty"`
 }
@@ -0,0 +1,86 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FilterOp string
+
+const (
+	OpEq     FilterOp = "eq"
+	OpNe     FilterOp = "ne"
+	OpLt     FilterOp = "lt"
+	OpLte    FilterOp = "lte"
+	OpGt     FilterOp = "gt"
+	OpGte    FilterOp = "gte"
+	OpIn     FilterOp = "in"
+	OpLike   FilterOp = "like"
+	OpIsNull FilterOp = "is-null"
+)
+
+type FieldType int
+
+const (
+	FieldString FieldType = iota
+	FieldInt
+	FieldBool
+	FieldTime
+)
+
+type FilterField struct {
+	Type     FieldType
+	Nullable bool
+}
+
+// DocumentFilterFields is the whitelist of document fields that can be used
+// in listing filters.
+var DocumentFilterFields = map[string]FilterField{
+	"id":      {Type: FieldString},
+	"name":    {Type: FieldString},
+	"mime":    {Type: FieldString, Nullable: true},
+	"file":    {Type: FieldBool},
+	"public":  {Type: FieldBool},
+	"created": {Type: FieldTime},
+	"updated": {Type: FieldTime},
+	"version": {Type: FieldInt},
+	"size":    {Type: FieldInt},
+}
+
+// FilterCondition is a single validated condition. Values hold string,
+// int64, bool or time.Time depending on the field type.
+type FilterCondition struct {
+	Field  string
+	Op     FilterOp
+	Values []interface{}
+}
+
+// Filter is a conjunction of conditions.
+type Filter []FilterCondition
+
+// String returns the canonical form of the filter, used in cache keys.
+func (f Filter) String() string {
+	conds := make([]string, len(f))
+	for i, cond := range f {
+		conds[i] = cond.Field + ":" + string(cond.Op) + ":" + formatValues(cond.Values)
+	}
+	return strings.Join(conds, ",")
+}
+
+func formatValues(values []interface{}) string {
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case string:
+			formatted[i] = strconv.Quote(v)
+		case int64:
+			formatted[i] = strconv.FormatInt(v, 10)
+		case bool:
+			formatted[i] = strconv.FormatBool(v)
+		case time.Time:
+			formatted[i] = v.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return strings.Join(formatted, "|")
+}
@@ -0,0 +1,82 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Grant permissions are ordered, every level includes the ones before it.
+const (
+	GrantRead   = "read"
+	GrantWrite  = "write"
+	GrantShare  = "share"
+	GrantDelete = "delete"
+)
+
+var GrantPermissions = []string{GrantRead, GrantWrite, GrantShare, GrantDelete}
+
+func ValidGrantPermission(permission string) bool {
+	for _, p := range GrantPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+type UserGrant struct {
+	Login      string `json:"login" db:"login"`
+	Permission string `json:"permission" db:"permission"`
+}
+
+// UnmarshalJSON also accepts a bare login, the format used before grants had
+// permissions, and reads it as a read grant.
+func (g *UserGrant) UnmarshalJSON(data []byte) error {
+	var login string
+	if err := json.Unmarshal(data, &login); err == nil {
+		*g = UserGrant{Login: login, Permission: GrantRead}
+		return nil
+	}
+	type plain UserGrant
+	var grant plain
+	if err := json.Unmarshal(data, &grant); err != nil {
+		return fmt.Errorf("invalid grant: %w", err)
+	}
+	if grant.Permission == "" {
+		grant.Permission = GrantRead
+	}
+	*g = UserGrant(grant)
+	return nil
+}
+
+type GroupGrant struct {
+	Group      string `json:"group" db:"name"`
+	Permission string `json:"permission" db:"permission"`
+}
+
+// UnmarshalJSON also accepts a bare group name, see UserGrant.
+func (g *GroupGrant) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*g = GroupGrant{Group: name, Permission: GrantRead}
+		return nil
+	}
+	type plain GroupGrant
+	var grant plain
+	if err := json.Unmarshal(data, &grant); err != nil {
+		return fmt.Errorf("invalid grant: %w", err)
+	}
+	if grant.Permission == "" {
+		grant.Permission = GrantRead
+	}
+	*g = GroupGrant(grant)
+	return nil
+}
+
+// GrantRequest shares a document with a user or a group, or revokes the
+// share when used to delete a grant.
+type GrantRequest struct {
+	Login      string `json:"login" form:"login"`
+	Group      string `json:"group" form:"group"`
+	Permission string `json:"permission" form:"-"`
+}
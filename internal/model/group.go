@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+type Group struct {
+	ID      int       `json:"id" db:"group_id"`
+	Name    string    `json:"name" db:"name"`
+	Created time.Time `json:"created" db:"created_at"`
+	Members []string  `json:"members,omitempty" db:"-"`
+}
+
+type GroupRequest struct {
+	Name    string   `json:"name" binding:"required,min=2,max=50"`
+	Members []string `json:"members"`
+}
@@ -0,0 +1,38 @@
+package model
+
+import "strconv"
+
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// Cursor points at the last document of a page: Values hold its sort keys
+// in the order of the sort fields and ID breaks ties.
+type Cursor struct {
+	Values []interface{}
+	ID     string
+}
+
+// String returns the canonical form of the cursor, used in cache keys.
+func (c *Cursor) String() string {
+	return formatValues(c.Values) + "|" + strconv.Quote(c.ID)
+}
+
+type DocumentQuery struct {
+	Login  string
+	Filter Filter
+	Sort   []SortField
+	Cursor *Cursor
+	Limit  int
+	Total  bool
+}
+
+type DocumentPage struct {
+	Docs       []*Document `json:"docs"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Total      *int        `json:"total,omitempty"`
+}
+
+// DefaultDocumentSort keeps the historical listing order.
+var DefaultDocumentSort = []SortField{{Field: "name"}, {Field: "created"}}
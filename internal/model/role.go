@@ -0,0 +1,46 @@
+package model
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleReader = "reader"
+)
+
+type Permission string
+
+const (
+	PermDocsRead  Permission = "docs:read"
+	PermDocsWrite Permission = "docs:write"
+	// PermDocsManage allows every call on documents of other users, with the
+	// access of their owners.
+	PermDocsManage  Permission = "docs:manage"
+	PermUsersManage Permission = "users:manage"
+)
+
+// DefaultRoles are given to registered users when no roles are requested.
+var DefaultRoles = []string{RoleEditor}
+
+var RolePermissions = map[string][]Permission{
+	RoleAdmin:  {PermDocsRead, PermDocsWrite, PermDocsManage, PermUsersManage},
+	RoleEditor: {PermDocsRead, PermDocsWrite},
+	RoleReader: {PermDocsRead},
+}
+
+// Can reports whether any of the principal's roles grants the permission.
+func (p *Principal) Can(perm Permission) bool {
+	if p == nil {
+		return false
+	}
+	for _, role := range p.Roles {
+		for _, granted := range RolePermissions[role] {
+			if granted == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type RolesRequest struct {
+	Roles []string `json:"roles" binding:"required"`
+}
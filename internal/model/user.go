@@ -1,18 +1,102 @@
 package model
 
+import "time"
+
 type User struct {
-	ID       int    `db:"user_id"`
-	Login    string `db:"login"`
-	Password string `db:"password_hash"`
+	ID       int       `json:"id" db:"user_id"`
+	Login    string    `json:"login" db:"login"`
+	Password string    `json:"-" db:"password_hash"`
+	Roles    []string  `json:"roles" db:"-"`
+	Disabled bool      `json:"disabled" db:"disabled"`
+	Created  time.Time `json:"created" db:"created_at"`
+}
+
+// UserPatch changes the fields that are set.
+type UserPatch struct {
+	Disabled *bool    `json:"disabled"`
+	Roles    []string `json:"roles"`
+}
+
+const (
+	DocumentsDelete   = "delete"
+	DocumentsTransfer = "transfer"
+)
+
+// UserDeletion tells what happens to the documents of a deleted user: they
+// are deleted or transferred to the user with login TransferTo.
+type UserDeletion struct {
+	Documents  string
+	TransferTo string
+}
+
+type PasswordChangeRequest struct {
+	Old string `json:"old" binding:"required"`
+	New string `json:"new" binding:"required,min=8,containsany=!@#$%^&*,containsany=ABCDEFGHIJKLMNOPQRSTUVWXYZ,containsany=abcdefghijklmnopqrstuvwxyz,containsany=0123456789"`
+}
+
+// Principal is the caller resolved from a session token. It is cached
+// between requests, so it only carries what access checks need.
+type Principal struct {
+	UserID int      `json:"user_id"`
+	Login  string   `json:"login"`
+	Roles  []string `json:"roles,omitempty"`
+}
+
+// Session is one login of a user. Its access token changes on every
+// refresh, the ID stays the same.
+type Session struct {
+	ID        int        `json:"id" db:"session_id"`
+	Token     string     `json:"-" db:"token"`
+	UserID    int        `json:"-" db:"user_id"`
+	Login     string     `json:"-" db:"login"`
+	Roles     []string   `json:"-" db:"-"`
+	FamilyID  string     `json:"-" db:"family_id"`
+	IP        string     `json:"ip,omitempty" db:"ip"`
+	UserAgent string     `json:"user_agent,omitempty" db:"user_agent"`
+	Created   time.Time  `json:"created" db:"created_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty" db:"last_used_at"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	Current   bool       `json:"current" db:"-"`
+}
+
+// ClientInfo describes where a login or refresh came from.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// RefreshToken is stored by hash only. Every refresh marks the token as used
+// and issues a new one in the same family, so a used token showing up again
+// means it was stolen.
+type RefreshToken struct {
+	ID        int        `db:"token_id"`
+	UserID    int        `db:"user_id"`
+	FamilyID  string     `db:"family_id"`
+	Hash      string     `db:"token_hash"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+type Tokens struct {
+	AccessToken      string    `json:"token"`
+	ExpiresAt        time.Time `json:"expires_at"`
+	RefreshToken     string    `json:"refresh_token"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
 }
 
 type RegisterRequest struct {
-	Token string `json:"token" binding:"required"`
-	Login string `json:"login" binding:"required,min=8,alphanum"`
-	Pswd  string `json:"pswd" binding:"required,min=8,containsany=!@#$%^&*,containsany=ABCDEFGHIJKLMNOPQRSTUVWXYZ,containsany=abcdefghijklmnopqrstuvwxyz,containsany=0123456789"`
+	Token string   `json:"token" binding:"required"`
+	Login string   `json:"login" binding:"required,min=8,alphanum"`
+	Pswd  string   `json:"pswd" binding:"required,min=8,containsany=!@#$%^&*,containsany=ABCDEFGHIJKLMNOPQRSTUVWXYZ,containsany=abcdefghijklmnopqrstuvwxyz,containsany=0123456789"`
+	Roles []string `json:"roles,omitempty"`
 }
 
 type AuthRequest struct {
 	Login string `json:"login" binding:"required"`
 	Pswd  string `json:"pswd" binding:"required"`
 }
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
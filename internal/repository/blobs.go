@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+var ErrBlobNotFound = errors.New("blob has not been found")
+
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore keeps file bodies outside of Postgres. Size passed to Put and
+// length passed to GetRange may be negative when they are not known.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (*BlobInfo, error)
+	// Walk calls fn for every stored blob, stopping at the first error.
+	Walk(ctx context.Context, fn func(*BlobInfo) error) error
+}
+
+type BlobStoreConfig struct {
+	Type  string
+	Local LocalBlobConfig
+	S3    S3BlobConfig
+}
+
+func NewBlobStore(config BlobStoreConfig) (BlobStore, error) {
+	switch config.Type {
+	case "", "local":
+		return NewLocalBlobStore(config.Local)
+	case "s3":
+		return NewS3BlobStore(config.S3)
+	default:
+		return nil, fmt.Errorf("unknown blob storage type: %s", config.Type)
+	}
+}
+
+func blobKey(documentID string, version int) string {
+	return documentID + "/" + strconv.Itoa(version)
+}
+
+// blobReader is a lazily opened, seekable view of a blob. Seeking drops the
+// open stream and the next read requests the blob from the new offset, so
+// ranges are served without downloading the whole body.
+type blobReader struct {
+	ctx    context.Context
+	store  BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func openBlob(ctx context.Context, store BlobStore, key string, size int64) (io.ReadSeekCloser, error) {
+	if size <= 0 {
+		info, err := store.Stat(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		size = info.Size
+	}
+	return &blobReader{ctx: ctx, store: store, key: key, size: size}, nil
+}
+
+func (b *blobReader) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		body, err := b.store.GetRange(b.ctx, b.key, b.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		b.body = body
+	}
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	return n, err
+}
+
+func (b *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != b.offset && b.body != nil {
+		b.body.Close()
+		b.body = nil
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *blobReader) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	return b.body.Close()
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
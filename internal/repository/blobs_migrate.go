@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type legacyFile struct {
+	DocumentID string `db:"document_id"`
+	Version    int    `db:"version"`
+}
+
+// MigrateBlobs moves file bodies that are still stored in BYTEA columns into
+// the blob store and returns the number of migrated rows.
+func MigrateBlobs(ctx context.Context, db *sqlx.DB, blobs BlobStore) (int, error) {
+	moved := 0
+	var versions []legacyFile
+	query := `SELECT document_id, version FROM document_versions
+	WHERE is_file = true AND blob_key IS NULL AND file_data IS NOT NULL`
+	if err := db.SelectContext(ctx, &versions, query); err != nil {
+		return moved, err
+	}
+	for _, v := range versions {
+		var data []byte
+		query = `SELECT file_data FROM document_versions WHERE document_id = $1 AND version = $2`
+		if err := db.GetContext(ctx, &data, query, v.DocumentID, v.Version); err != nil {
+			return moved, err
+		}
+		key := blobKey(v.DocumentID, v.Version)
+		if err := blobs.Put(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+			return moved, err
+		}
+		query = `UPDATE document_versions SET blob_key = $1, size = $2, file_data = NULL
+		WHERE document_id = $3 AND version = $4`
+		if _, err := db.ExecContext(ctx, query, key, len(data), v.DocumentID, v.Version); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	var files []legacyFile
+	query = `SELECT f.document_id, d.version FROM document_files f
+	JOIN documents d ON d.id = f.document_id
+	WHERE f.blob_key IS NULL`
+	if err := db.SelectContext(ctx, &files, query); err != nil {
+		return moved, err
+	}
+	for _, f := range files {
+		var data []byte
+		query = `SELECT data FROM document_files WHERE document_id = $1`
+		if err := db.GetContext(ctx, &data, query, f.DocumentID); err != nil {
+			return moved, err
+		}
+		// The current body is the same as the body of the latest revision,
+		// which has normally been moved above already.
+		var key sql.NullString
+		query = `SELECT blob_key FROM document_versions WHERE document_id = $1 AND version = $2`
+		if err := db.GetContext(ctx, &key, query, f.DocumentID, f.Version); err != nil && err != sql.ErrNoRows {
+			return moved, err
+		}
+		if !key.Valid {
+			key = sql.NullString{String: blobKey(f.DocumentID, f.Version), Valid: true}
+			if err := blobs.Put(ctx, key.String, bytes.NewReader(data), int64(len(data))); err != nil {
+				return moved, err
+			}
+		}
+		query = `UPDATE document_files SET blob_key = $1, size = $2, data = NULL WHERE document_id = $3`
+		if _, err := db.ExecContext(ctx, query, key.String, len(data), f.DocumentID); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
@@ -1,184 +1,366 @@
 package repository
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
+	"io"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lavatee/astraltest/internal/apperror"
 	"github.com/lavatee/astraltest/internal/model"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrDocumentNotFound is returned for missing documents and for those
+	// the user can not see, so that documents of others look like missing
+	// ones.
+	ErrDocumentNotFound = apperror.New(apperror.NotFound, "Document not found")
+	// ErrNoPermission is returned when the user can see the document but
+	// lacks the permission the change requires.
+	ErrNoPermission = apperror.New(apperror.Forbidden, "Permission denied")
 )
 
 type DocumentsPostgres struct {
-	db *sqlx.DB
+	db    *sqlx.DB
+	blobs BlobStore
 }
 
-func NewDocumentsPostgres(db *sqlx.DB) *DocumentsPostgres {
-	return &DocumentsPostgres{db: db}
+func NewDocumentsPostgres(db *sqlx.DB, blobs BlobStore) *DocumentsPostgres {
+	return &DocumentsPostgres{db: db, blobs: blobs}
 }
 
-func (r *DocumentsPostgres) Create(ctx context.Context, token string, doc *model.Document, jsonData string, fileData []byte) error {
+// content is the body of a single revision: inline JSON for data documents
+// or a reference to the blob store for files.
+type content struct {
+	data string
+	key  string
+	size int64
+	hash string
+}
+
+func (r *DocumentsPostgres) Create(ctx context.Context, userID int, doc *model.Document, jsonData string, file io.Reader) error {
+	doc.Version = 1
+	doc.Updated = doc.Created
+	c, err := r.putContent(ctx, doc, jsonData, file)
+	if err != nil {
+		return err
+	}
 	tx, err := r.db.BeginTxx(ctx, nil)
 	if err != nil {
+		r.discardBlob(c.key)
 		return err
 	}
-	defer tx.Rollback()
-	query := `INSERT INTO documents (id, name, mime, is_file, is_public, created_at, owner_id)
-	VALUES ($1, $2, $3, $4, $5, $6, 
-	(SELECT user_id FROM sessions WHERE token = $7))`
+	committed := false
+	defer func() {
+		tx.Rollback()
+		if !committed {
+			r.discardBlob(c.key)
+		}
+	}()
+	query := `INSERT INTO documents (id, name, mime, is_file, is_public, created_at, updated_at, owner_id, version)
+	VALUES ($1, $2, $3, $4, $5, $6, $6, $7, $8)`
 	_, err = tx.ExecContext(ctx, query,
-		doc.ID, doc.Name, doc.Mime, doc.File, doc.Public, doc.Created, token)
+		doc.ID, doc.Name, doc.Mime, doc.File, doc.Public, doc.Created, userID, doc.Version)
 	if err != nil {
 		return err
 	}
-	query = `INSERT INTO document_files (document_id, data) VALUES ($1, $2)`
-	if doc.File {
-		_, err = tx.ExecContext(ctx, query, doc.ID, fileData)
-	} else {
-		query = `INSERT INTO document_data (document_id, data) VALUES ($1, $2)`
-		_, err = tx.ExecContext(ctx, query, doc.ID, jsonData)
+	if err = writeContent(ctx, tx, doc, c); err != nil {
+		return err
 	}
+	if err = insertVersion(ctx, tx, doc, c); err != nil {
+		return err
+	}
+	for _, grant := range doc.Grant {
+		query = `INSERT INTO document_grants (document_id, user_id, permission)
+		SELECT $1, user_id, $3 FROM users WHERE login = $2`
+		if err = insertGrant(ctx, tx, query, doc.ID, grant.Login, grant.Permission); err != nil {
+			return notFound(err, "User "+grant.Login+" not found")
+		}
+	}
+	for _, grant := range doc.GrantGroups {
+		query = `INSERT INTO document_grants (document_id, group_id, permission)
+		SELECT $1, group_id, $3 FROM groups WHERE name = $2`
+		if err = insertGrant(ctx, tx, query, doc.ID, grant.Group, grant.Permission); err != nil {
+			return notFound(err, "Group "+grant.Group+" not found")
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+func (r *DocumentsPostgres) Update(ctx context.Context, userID int, doc *model.Document, jsonData string, file io.Reader) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	if len(doc.Grant) > 0 {
-		for _, login := range doc.Grant {
-			query = `INSERT INTO document_grants (document_id, user_id)
-			VALUES ($1, (SELECT user_id FROM users WHERE login = $2))`
-			_, err = tx.ExecContext(ctx, query, doc.ID, login)
-			if err != nil {
-				return err
-			}
+	var c content
+	committed := false
+	defer func() {
+		tx.Rollback()
+		if !committed {
+			r.discardBlob(c.key)
 		}
+	}()
+	if err = requirePermissions(ctx, tx, userID, doc.ID, model.GrantWrite); err != nil {
+		return err
+	}
+	query := `UPDATE documents SET name = $1, mime = $2, is_file = $3, version = version + 1
+	WHERE id = $4
+	RETURNING is_public, created_at, version`
+	err = tx.QueryRowxContext(ctx, query, doc.Name, doc.Mime, doc.File, doc.ID).
+		Scan(&doc.Public, &doc.Created, &doc.Version)
+	if err != nil {
+		return err
+	}
+	doc.Updated = time.Now()
+	if c, err = r.putContent(ctx, doc, jsonData, file); err != nil {
+		return err
+	}
+	if err = writeContent(ctx, tx, doc, c); err != nil {
+		return err
+	}
+	if err = insertVersion(ctx, tx, doc, c); err != nil {
+		return err
+	}
+	if err = loadGrants(ctx, tx, doc); err != nil {
+		return err
 	}
-	return tx.Commit()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
 }
 
-func (r *DocumentsPostgres) GetAll(ctx context.Context, token, login, key, value string, limit int) ([]*model.Document, error) {
-	query := `SELECT d.id, d.name, d.mime, d.is_file, d.is_public, d.created_at
-	FROM documents d
-	JOIN sessions s ON s.token = $1
-	WHERE (d.owner_id = s.user_id OR d.is_public = true OR EXISTS (
-	SELECT 1 FROM document_grants g 
-	WHERE g.document_id = d.id AND g.user_id = s.user_id
-	))`
-	params := []interface{}{token}
-	if login != "" {
-		query += ` AND d.owner_id = (SELECT user_id FROM users WHERE login = $2)`
-		params = append(params, login)
+func (r *DocumentsPostgres) GetAll(ctx context.Context, userID int, q model.DocumentQuery) ([]*model.Document, error) {
+	query := `SELECT d.id, d.name, d.mime, d.is_file, d.is_public, d.created_at, d.updated_at, d.version, d.size, d.hash
+	FROM documents d`
+	query, params, err := documentsWhere(query, userID, q)
+	if err != nil {
+		return nil, err
 	}
-	if key != "" && value != "" {
-		query += ` AND d.` + key + ` = $` + strconv.Itoa(len(params)+1)
-		params = append(params, value)
+	if q.Cursor != nil {
+		if query, params, err = appendCursor(query, params, q.Sort, q.Cursor); err != nil {
+			return nil, err
+		}
+	}
+	query, err = appendOrder(query, q.Sort)
+	if err != nil {
+		return nil, err
 	}
-	query += ` ORDER BY d.name, d.created_at`
-	if limit > 0 {
+	if q.Limit > 0 {
 		query += ` LIMIT $` + strconv.Itoa(len(params)+1)
-		params = append(params, limit)
+		params = append(params, q.Limit)
 	}
 	var docs []*model.Document
-	err := r.db.SelectContext(ctx, &docs, query, params...)
+	err = r.db.SelectContext(ctx, &docs, query, params...)
 	if err != nil {
 		return nil, err
 	}
 	for _, doc := range docs {
-		var grants []string
-		err := r.db.SelectContext(ctx, &grants, `
-			SELECT u.login 
-			FROM document_grants g
-			JOIN users u ON u.user_id = g.user_id
-			WHERE g.document_id = $1`, doc.ID)
-		if err != nil {
+		if err := loadGrants(ctx, r.db, doc); err != nil {
 			return nil, err
 		}
-		doc.Grant = grants
 	}
 	return docs, nil
 }
 
-func (r *DocumentsPostgres) GetByID(ctx context.Context, token, id string) (*model.Document, []byte, error) {
-	var hasAccess bool
-	query := `SELECT EXISTS(
-	SELECT 1 FROM documents d
-	JOIN sessions s ON s.token = $1
-	WHERE d.id = $2 AND (d.owner_id = s.user_id OR d.is_public = true OR EXISTS (
-	SELECT 1 FROM document_grants g 
-	WHERE g.document_id = d.id AND g.user_id = s.user_id
-	))
-	)`
-	err := r.db.GetContext(ctx, &hasAccess, query, token, id)
-	if err != nil || !hasAccess {
-		return nil, nil, errors.New("User doesn't have access to this file")
+func (r *DocumentsPostgres) Count(ctx context.Context, userID int, q model.DocumentQuery) (int, error) {
+	query, params, err := documentsWhere(`SELECT COUNT(*) FROM documents d`, userID, q)
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	err = r.db.GetContext(ctx, &total, query, params...)
+	return total, err
+}
+
+// documentsWhere appends the access check, owner and filter conditions of
+// a listing to a query selecting from documents d.
+func documentsWhere(query string, userID int, q model.DocumentQuery) (string, []interface{}, error) {
+	query += `
+	WHERE (d.owner_id = $1 OR d.is_public = true OR ` + grantedTo + `)`
+	params := []interface{}{userID}
+	if q.Login != "" {
+		query += ` AND d.owner_id = (SELECT user_id FROM users WHERE login = $2)`
+		params = append(params, q.Login)
+	}
+	return appendFilter(query, params, q.Filter)
+}
+
+func (r *DocumentsPostgres) GetByID(ctx context.Context, userID int, id string) (*model.Document, io.ReadCloser, error) {
+	if err := requireAccess(ctx, r.db, userID, id); err != nil {
+		return nil, nil, err
+	}
+	doc, err := getDocument(ctx, r.db, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := r.openContent(ctx, doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, body, nil
+}
+
+func (r *DocumentsPostgres) GetFileData(ctx context.Context, userID int, id string) (io.ReadCloser, error) {
+	if err := requireAccess(ctx, r.db, userID, id); err != nil {
+		return nil, err
 	}
 	var doc model.Document
-	query = `SELECT id, name, mime, is_file, is_public, created_at
+	query := `SELECT id, name, mime, is_file, is_public, created_at, updated_at, version, size, hash
 	FROM documents WHERE id = $1`
-	err = r.db.GetContext(ctx, &doc, query, id)
-	if err != nil {
-		return nil, nil, errors.New("Document has not been found")
+	if err := r.db.GetContext(ctx, &doc, query, id); err != nil {
+		return nil, documentNotFound(err)
 	}
-	var grants []string
-	query = `SELECT u.login 
-	FROM document_grants g
-	JOIN users u ON u.user_id = g.user_id
-	WHERE g.document_id = $1`
-	err = r.db.SelectContext(ctx, &grants, query, id)
+	return r.openContent(ctx, &doc)
+}
+
+// GetMeta returns the metadata and grants of the document without checking
+// access, for callers that check it on their own.
+func (r *DocumentsPostgres) GetMeta(ctx context.Context, id string) (*model.Document, error) {
+	return getDocument(ctx, r.db, id)
+}
+
+func (r *DocumentsPostgres) GetACL(ctx context.Context, id string) (*model.DocumentACL, error) {
+	var acl model.DocumentACL
+	query := `SELECT owner_id, is_public FROM documents WHERE id = $1`
+	if err := r.db.GetContext(ctx, &acl, query, id); err != nil {
+		return nil, documentNotFound(err)
+	}
+	query = `SELECT user_id FROM document_grants WHERE document_id = $1 AND user_id IS NOT NULL`
+	if err := r.db.SelectContext(ctx, &acl.Users, query, id); err != nil {
+		return nil, err
+	}
+	query = `SELECT group_id FROM document_grants WHERE document_id = $1 AND group_id IS NOT NULL`
+	if err := r.db.SelectContext(ctx, &acl.Groups, query, id); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+func (r *DocumentsPostgres) GetVersions(ctx context.Context, userID int, id string) ([]*model.DocumentVersion, error) {
+	if err := requireAccess(ctx, r.db, userID, id); err != nil {
+		return nil, err
+	}
+	var versions []*model.DocumentVersion
+	query := `SELECT version, name, mime, is_file, created_at, COALESCE(size, 0) AS size, hash
+	FROM document_versions
+	WHERE document_id = $1
+	ORDER BY version DESC`
+	if err := r.db.SelectContext(ctx, &versions, query, id); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (r *DocumentsPostgres) GetVersion(ctx context.Context, userID int, id string, version int) (*model.DocumentVersion, io.ReadCloser, error) {
+	if err := requireAccess(ctx, r.db, userID, id); err != nil {
+		return nil, nil, err
+	}
+	ver, c, legacy, err := getVersion(ctx, r.db, id, version)
 	if err != nil {
-		return nil, nil, errors.New("Grants have not been found")
+		return nil, nil, err
 	}
-	doc.Grant = grants
-	var data []byte
-	if doc.File {
-		query = `SELECT data FROM document_files WHERE document_id = $1`
-		err = r.db.GetContext(ctx, &data, query, id)
-	} else {
-		query = `SELECT data FROM document_data WHERE document_id = $1`
-		err = r.db.GetContext(ctx, &data, query, id)
+	if !ver.File {
+		return ver, nopSeekCloser{strings.NewReader(c.data)}, nil
+	}
+	if c.key == "" {
+		return ver, nopSeekCloser{bytes.NewReader(legacy)}, nil
 	}
+	body, err := openBlob(ctx, r.blobs, c.key, c.size)
 	if err != nil {
 		return nil, nil, err
 	}
-	return &doc, data, nil
+	return ver, body, nil
 }
 
-func (r *DocumentsPostgres) GetFileData(ctx context.Context, token, id string) ([]byte, error) {
-	var doc model.Document
-	query := `SELECT id, name, mime, is_file, is_public, created_at
-	FROM documents WHERE id = $1`
-	err := r.db.GetContext(ctx, &doc, query, id)
+func (r *DocumentsPostgres) RestoreVersion(ctx context.Context, userID int, id string, version int) (*model.Document, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
 	if err != nil {
-		return nil, errors.New("Document has not been found")
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err = requirePermissions(ctx, tx, userID, id, model.GrantWrite); err != nil {
+		return nil, err
+	}
+	ver, _, _, err := getVersion(ctx, tx, id, version)
+	if err != nil {
+		return nil, err
+	}
+	doc := &model.Document{
+		ID:   id,
+		Name: ver.Name,
+		Mime: ver.Mime,
+		File: ver.File,
+	}
+	query := `UPDATE documents SET name = $1, mime = $2, is_file = $3, size = $4, hash = $5,
+	version = version + 1, updated_at = NOW()
+	WHERE id = $6
+	RETURNING is_public, created_at, updated_at, version, size, hash`
+	err = tx.QueryRowxContext(ctx, query, ver.Name, ver.Mime, ver.File, ver.Size, ver.Hash, doc.ID).
+		Scan(&doc.Public, &doc.Created, &doc.Updated, &doc.Version, &doc.Size, &doc.Hash)
+	if err != nil {
+		return nil, err
+	}
+	// The restored revision shares the body of the old one, so the blob is
+	// referenced again instead of being copied.
+	query = `INSERT INTO document_versions (document_id, version, name, mime, is_file, created_at, data, file_data, blob_key, size, hash)
+	SELECT document_id, $3, name, mime, is_file, $4, data, file_data, blob_key, size, hash
+	FROM document_versions WHERE document_id = $1 AND version = $2`
+	if _, err = tx.ExecContext(ctx, query, id, version, doc.Version, doc.Updated); err != nil {
+		return nil, err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM document_files WHERE document_id = $1`, id); err != nil {
+		return nil, err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM document_data WHERE document_id = $1`, id); err != nil {
+		return nil, err
 	}
-	var data []byte
 	if doc.File {
-		query = `SELECT data FROM document_files WHERE document_id = $1`
-		err = r.db.GetContext(ctx, &data, query, id)
+		query = `INSERT INTO document_files (document_id, data, blob_key, size)
+		SELECT document_id, file_data, blob_key, size
+		FROM document_versions WHERE document_id = $1 AND version = $2`
 	} else {
-		query = `SELECT data FROM document_data WHERE document_id = $1`
-		err = r.db.GetContext(ctx, &data, query, id)
+		query = `INSERT INTO document_data (document_id, data)
+		SELECT document_id, data
+		FROM document_versions WHERE document_id = $1 AND version = $2`
 	}
-	if err != nil {
-		err = errors.New("File data has not been found")
+	if _, err = tx.ExecContext(ctx, query, id, version); err != nil {
+		return nil, err
+	}
+	if err = loadGrants(ctx, tx, doc); err != nil {
+		return nil, err
 	}
-	return data, err
+	return doc, tx.Commit()
 }
 
-func (r *DocumentsPostgres) Delete(ctx context.Context, token, id string) error {
+func (r *DocumentsPostgres) Delete(ctx context.Context, userID int, id string) error {
 	tx, err := r.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
-	var isOwner bool
-	query := `SELECT EXISTS(
-	SELECT 1 FROM documents d
-	JOIN sessions s ON s.token = $1
-	WHERE d.id = $2 AND d.owner_id = s.user_id
-	)`
-	err = tx.GetContext(ctx, &isOwner, query, token, id)
-	if err != nil || !isOwner {
-		return sql.ErrNoRows
+	if err = requirePermissions(ctx, tx, userID, id, model.GrantDelete); err != nil {
+		return err
+	}
+	var keys []string
+	query := `SELECT blob_key FROM document_versions WHERE document_id = $1 AND blob_key IS NOT NULL
+	UNION
+	SELECT blob_key FROM document_files WHERE document_id = $1 AND blob_key IS NOT NULL`
+	if err = tx.SelectContext(ctx, &keys, query, id); err != nil {
+		return err
 	}
 	query = `DELETE FROM document_grants WHERE document_id = $1`
 	_, err = tx.ExecContext(ctx, query, id)
@@ -195,10 +377,410 @@ func (r *DocumentsPostgres) Delete(ctx context.Context, token, id string) error
 	if err != nil {
 		return err
 	}
+	query = `DELETE FROM document_versions WHERE document_id = $1`
+	_, err = tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
 	query = `DELETE FROM documents WHERE id = $1`
 	_, err = tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
-	return tx.Commit()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		r.discardBlob(key)
+	}
+	return nil
+}
+
+// Patch changes name and mime with write permission and the public flag,
+// which shares the document with everyone, with share permission.
+func (r *DocumentsPostgres) Patch(ctx context.Context, userID int, id string, patch model.DocumentPatch) (*model.Document, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var required []string
+	if patch.Public != nil {
+		required = append(required, model.GrantShare)
+	}
+	if patch.Name != nil || patch.Mime != nil || patch.Public == nil {
+		required = append(required, model.GrantWrite)
+	}
+	if err = requirePermissions(ctx, tx, userID, id, required...); err != nil {
+		return nil, err
+	}
+	query := `UPDATE documents SET name = COALESCE($1, name), mime = COALESCE($2, mime),
+	is_public = COALESCE($3, is_public), updated_at = NOW()
+	WHERE id = $4`
+	if _, err = tx.ExecContext(ctx, query, patch.Name, patch.Mime, patch.Public, id); err != nil {
+		return nil, err
+	}
+	doc, err := getDocument(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return doc, tx.Commit()
+}
+
+// AddGrant shares the document with a user or a group, replacing the
+// permission of an existing grant. Sharing requires share permission and
+// the granted permission itself, so nobody hands out more than they have.
+func (r *DocumentsPostgres) AddGrant(ctx context.Context, userID int, id string, grant model.GrantRequest) (*model.Document, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err = requirePermissions(ctx, tx, userID, id, model.GrantShare, grant.Permission); err != nil {
+		return nil, err
+	}
+	var query, target string
+	if grant.Login != "" {
+		query = `INSERT INTO document_grants (document_id, user_id, permission)
+		SELECT $1, user_id, $3 FROM users WHERE login = $2
+		ON CONFLICT (document_id, user_id) DO UPDATE SET permission = EXCLUDED.permission`
+		target = grant.Login
+	} else {
+		query = `INSERT INTO document_grants (document_id, group_id, permission)
+		SELECT $1, group_id, $3 FROM groups WHERE name = $2
+		ON CONFLICT (document_id, group_id) DO UPDATE SET permission = EXCLUDED.permission`
+		target = grant.Group
+	}
+	if err = insertGrant(ctx, tx, query, id, target, grant.Permission); err != nil {
+		return nil, notFound(err, "User or group not found")
+	}
+	doc, err := getDocument(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return doc, tx.Commit()
+}
+
+// RevokeGrant removes the grant of a user or a group. Like sharing, it
+// requires share permission and the permission of the revoked grant.
+func (r *DocumentsPostgres) RevokeGrant(ctx context.Context, userID int, id string, grant model.GrantRequest) (*model.Document, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var where, target string
+	if grant.Login != "" {
+		where = `user_id = (SELECT user_id FROM users WHERE login = $2)`
+		target = grant.Login
+	} else {
+		where = `group_id = (SELECT group_id FROM groups WHERE name = $2)`
+		target = grant.Group
+	}
+	if err = requirePermissions(ctx, tx, userID, id, model.GrantShare); err != nil {
+		return nil, err
+	}
+	var permission string
+	query := `SELECT permission FROM document_grants WHERE document_id = $1 AND ` + where
+	if err = tx.GetContext(ctx, &permission, query, id, target); err != nil {
+		return nil, notFound(err, "Grant not found")
+	}
+	if err = requirePermissions(ctx, tx, userID, id, permission); err != nil {
+		return nil, err
+	}
+	query = `DELETE FROM document_grants WHERE document_id = $1 AND ` + where
+	if _, err = tx.ExecContext(ctx, query, id, target); err != nil {
+		return nil, err
+	}
+	doc, err := getDocument(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return doc, tx.Commit()
+}
+
+// requireAccess fails with ErrDocumentNotFound unless the user can see the
+// document.
+func requireAccess(ctx context.Context, q sqlx.QueryerContext, userID int, id string) error {
+	access, err := hasAccess(ctx, q, userID, id)
+	if err != nil {
+		return err
+	}
+	if !access {
+		return ErrDocumentNotFound
+	}
+	return nil
+}
+
+// requirePermissions fails unless the user has all of the permissions: with
+// ErrDocumentNotFound if it can not even see the document and with
+// ErrNoPermission otherwise.
+func requirePermissions(ctx context.Context, q sqlx.QueryerContext, userID int, id string, permissions ...string) error {
+	for _, p := range permissions {
+		allowed, err := hasPermission(ctx, q, userID, id, p)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			if err := requireAccess(ctx, q, userID, id); err != nil {
+				return err
+			}
+			return ErrNoPermission
+		}
+	}
+	return nil
+}
+
+// insertGrant runs a query inserting the grant of the target selected by
+// name and fails with sql.ErrNoRows if there is no such target.
+func insertGrant(ctx context.Context, e sqlx.ExecerContext, query, id, target, permission string) error {
+	res, err := e.ExecContext(ctx, query, id, target, permission)
+	if err != nil {
+		return conflict(err, "Document is already shared with "+target)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+func documentNotFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrDocumentNotFound
+	}
+	return err
+}
+
+// getDocument returns the metadata and grants of the document.
+func getDocument(ctx context.Context, q sqlx.QueryerContext, id string) (*model.Document, error) {
+	var doc model.Document
+	query := `SELECT id, name, mime, is_file, is_public, created_at, updated_at, version, size, hash
+	FROM documents WHERE id = $1`
+	if err := sqlx.GetContext(ctx, q, &doc, query, id); err != nil {
+		return nil, documentNotFound(err)
+	}
+	if err := loadGrants(ctx, q, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (r *DocumentsPostgres) GetOwner(ctx context.Context, id string) (int, error) {
+	var ownerID int
+	err := r.db.GetContext(ctx, &ownerID, `SELECT owner_id FROM documents WHERE id = $1`, id)
+	return ownerID, documentNotFound(err)
+}
+
+func (r *DocumentsPostgres) IsPublic(ctx context.Context, id string) (bool, error) {
+	var public bool
+	err := r.db.GetContext(ctx, &public, `SELECT is_public FROM documents WHERE id = $1`, id)
+	return public, documentNotFound(err)
+}
+
+func (r *DocumentsPostgres) GetOwnedIDs(ctx context.Context, userID int) ([]string, error) {
+	var ids []string
+	err := r.db.SelectContext(ctx, &ids, `SELECT id FROM documents WHERE owner_id = $1 ORDER BY id`, userID)
+	return ids, err
+}
+
+// grantedTo is true for documents d shared with user $1, directly or
+// through one of its groups.
+const grantedTo = `EXISTS (
+	SELECT 1 FROM document_grants g
+	WHERE g.document_id = d.id AND (g.user_id = $1 OR g.group_id IN (
+	SELECT m.group_id FROM group_members m WHERE m.user_id = $1
+	))
+	)`
+
+// GetAudience returns the users who can see the document through ownership
+// or grants, group members included.
+func (r *DocumentsPostgres) GetAudience(ctx context.Context, id string) ([]int, error) {
+	var users []int
+	query := `SELECT owner_id FROM documents WHERE id = $1
+	UNION
+	SELECT g.user_id FROM document_grants g WHERE g.document_id = $1 AND g.user_id IS NOT NULL
+	UNION
+	SELECT m.user_id FROM document_grants g
+	JOIN group_members m ON m.group_id = g.group_id
+	WHERE g.document_id = $1`
+	err := r.db.SelectContext(ctx, &users, query, id)
+	return users, err
+}
+
+func hasAccess(ctx context.Context, q sqlx.QueryerContext, userID int, id string) (bool, error) {
+	var access bool
+	query := `SELECT EXISTS(
+	SELECT 1 FROM documents d
+	WHERE d.id = $2 AND (d.owner_id = $1 OR d.is_public = true OR ` + grantedTo + `)
+	)`
+	err := sqlx.GetContext(ctx, q, &access, query, userID, id)
+	return access, err
+}
+
+// hasPermission reports whether the user owns the document or has been
+// granted the permission, or a higher one, directly or through a group.
+func hasPermission(ctx context.Context, q sqlx.QueryerContext, userID int, id, permission string) (bool, error) {
+	var allowed bool
+	query := `SELECT EXISTS(
+	SELECT 1 FROM documents d
+	WHERE d.id = $2 AND d.owner_id = $1
+	) OR EXISTS(
+	SELECT 1 FROM document_grants g
+	WHERE g.document_id = $2 AND (g.user_id = $1 OR g.group_id IN (
+	SELECT m.group_id FROM group_members m WHERE m.user_id = $1
+	))
+	AND array_position($3::text[], g.permission) >= array_position($3::text[], $4)
+	)`
+	err := sqlx.GetContext(ctx, q, &allowed, query, userID, id, pq.Array(model.GrantPermissions), permission)
+	return allowed, err
+}
+
+func loadGrants(ctx context.Context, q sqlx.QueryerContext, doc *model.Document) error {
+	doc.Grant, doc.GrantGroups = nil, nil
+	query := `SELECT u.login, g.permission
+	FROM document_grants g
+	JOIN users u ON u.user_id = g.user_id
+	WHERE g.document_id = $1
+	ORDER BY u.login`
+	if err := sqlx.SelectContext(ctx, q, &doc.Grant, query, doc.ID); err != nil {
+		return err
+	}
+	query = `SELECT gr.name, g.permission
+	FROM document_grants g
+	JOIN groups gr ON gr.group_id = g.group_id
+	WHERE g.document_id = $1
+	ORDER BY gr.name`
+	return sqlx.SelectContext(ctx, q, &doc.GrantGroups, query, doc.ID)
+}
+
+// putContent streams the body of a file document to the blob store under
+// the key of its current version, hashing and sizing it on the way.
+func (r *DocumentsPostgres) putContent(ctx context.Context, doc *model.Document, jsonData string, file io.Reader) (content, error) {
+	if !doc.File {
+		hash := sha256.Sum256([]byte(jsonData))
+		c := content{data: jsonData, size: int64(len(jsonData)), hash: hex.EncodeToString(hash[:])}
+		doc.Size, doc.Hash = c.size, c.hash
+		return c, nil
+	}
+	hash := sha256.New()
+	counter := &countingReader{r: io.TeeReader(file, hash)}
+	key := blobKey(doc.ID, doc.Version)
+	if err := r.blobs.Put(ctx, key, counter, -1); err != nil {
+		r.discardBlob(key)
+		return content{}, err
+	}
+	c := content{key: key, size: counter.n, hash: hex.EncodeToString(hash.Sum(nil))}
+	doc.Size, doc.Hash = c.size, c.hash
+	return c, nil
+}
+
+// discardBlob removes a blob that is no longer referenced. Failures are
+// ignored: the blob is left behind as an orphan.
+func (r *DocumentsPostgres) discardBlob(key string) {
+	if key == "" {
+		return
+	}
+	r.blobs.Delete(context.Background(), key)
+}
+
+// openContent opens the current body of the document. Files that were
+// uploaded before the blob store existed are still read from BYTEA.
+func (r *DocumentsPostgres) openContent(ctx context.Context, doc *model.Document) (io.ReadCloser, error) {
+	if !doc.File {
+		var data string
+		query := `SELECT data FROM document_data WHERE document_id = $1`
+		if err := r.db.GetContext(ctx, &data, query, doc.ID); err != nil {
+			return nil, err
+		}
+		return nopSeekCloser{strings.NewReader(data)}, nil
+	}
+	var row struct {
+		Key  sql.NullString `db:"blob_key"`
+		Size sql.NullInt64  `db:"size"`
+	}
+	query := `SELECT blob_key, size FROM document_files WHERE document_id = $1`
+	if err := r.db.GetContext(ctx, &row, query, doc.ID); err != nil {
+		return nil, err
+	}
+	if row.Key.Valid {
+		return openBlob(ctx, r.blobs, row.Key.String, row.Size.Int64)
+	}
+	var data []byte
+	query = `SELECT data FROM document_files WHERE document_id = $1`
+	if err := r.db.GetContext(ctx, &data, query, doc.ID); err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeContent replaces the current body of the document, which lives in
+// document_files or document_data depending on the document type.
+func writeContent(ctx context.Context, tx *sqlx.Tx, doc *model.Document, c content) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM document_files WHERE document_id = $1`, doc.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM document_data WHERE document_id = $1`, doc.ID); err != nil {
+		return err
+	}
+	query := `UPDATE documents SET size = $1, hash = $2, updated_at = $3 WHERE id = $4`
+	if _, err := tx.ExecContext(ctx, query, c.size, c.hash, doc.Updated, doc.ID); err != nil {
+		return err
+	}
+	var err error
+	if doc.File {
+		query := `INSERT INTO document_files (document_id, blob_key, size) VALUES ($1, $2, $3)`
+		_, err = tx.ExecContext(ctx, query, doc.ID, c.key, c.size)
+	} else {
+		query := `INSERT INTO document_data (document_id, data) VALUES ($1, $2)`
+		_, err = tx.ExecContext(ctx, query, doc.ID, c.data)
+	}
+	return err
+}
+
+func insertVersion(ctx context.Context, tx *sqlx.Tx, doc *model.Document, c content) error {
+	var data, key sql.NullString
+	if doc.File {
+		key = sql.NullString{String: c.key, Valid: true}
+	} else {
+		data = sql.NullString{String: c.data, Valid: true}
+	}
+	query := `INSERT INTO document_versions (document_id, version, name, mime, is_file, created_at, data, blob_key, size, hash)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	_, err := tx.ExecContext(ctx, query,
+		doc.ID, doc.Version, doc.Name, doc.Mime, doc.File, doc.Updated, data, key, c.size, c.hash)
+	return err
+}
+
+// getVersion returns the revision metadata and its content. legacy holds the
+// BYTEA body of files that have not been moved to the blob store yet.
+func getVersion(ctx context.Context, q sqlx.QueryerContext, id string, version int) (*model.DocumentVersion, content, []byte, error) {
+	var row struct {
+		model.DocumentVersion
+		Data     sql.NullString `db:"data"`
+		FileData []byte         `db:"file_data"`
+		Key      sql.NullString `db:"blob_key"`
+	}
+	query := `SELECT version, name, mime, is_file, created_at, COALESCE(size, 0) AS size, hash, data, file_data, blob_key
+	FROM document_versions
+	WHERE document_id = $1 AND version = $2`
+	err := sqlx.GetContext(ctx, q, &row, query, id, version)
+	if err != nil {
+		return nil, content{}, nil, notFound(err, "Version not found")
+	}
+	c := content{data: row.Data.String, key: row.Key.String, size: row.Size, hash: row.Hash}
+	return &row.DocumentVersion, c, row.FileData, nil
 }
@@ -0,0 +1,152 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lavatee/astraltest/internal/model"
+)
+
+var documentFilterColumns = map[string]string{
+	"id":      "d.id",
+	"name":    "d.name",
+	"mime":    "d.mime",
+	"file":    "d.is_file",
+	"public":  "d.is_public",
+	"created": "d.created_at",
+	"updated": "d.updated_at",
+	"version": "d.version",
+	"size":    "d.size",
+}
+
+var filterOperators = map[model.FilterOp]string{
+	model.OpEq:  "=",
+	model.OpNe:  "IS DISTINCT FROM",
+	model.OpLt:  "<",
+	model.OpLte: "<=",
+	model.OpGt:  ">",
+	model.OpGte: ">=",
+}
+
+// appendFilter compiles the filter into parameterized conditions on the
+// documents table aliased as d. Only whitelisted columns are ever written
+// into the query text, values always go to params.
+func appendFilter(query string, params []interface{}, filter model.Filter) (string, []interface{}, error) {
+	for _, cond := range filter {
+		column, ok := documentFilterColumns[cond.Field]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown filter field %q", cond.Field)
+		}
+		if len(cond.Values) == 0 {
+			return "", nil, fmt.Errorf("filter on %q has no value", cond.Field)
+		}
+		switch cond.Op {
+		case model.OpIsNull:
+			if isNull, _ := cond.Values[0].(bool); isNull {
+				query += ` AND ` + column + ` IS NULL`
+			} else {
+				query += ` AND ` + column + ` IS NOT NULL`
+			}
+		case model.OpIn:
+			placeholders := make([]string, len(cond.Values))
+			for i, value := range cond.Values {
+				params = append(params, value)
+				placeholders[i] = `$` + strconv.Itoa(len(params))
+			}
+			query += ` AND ` + column + ` IN (` + strings.Join(placeholders, ", ") + `)`
+		case model.OpLike:
+			pattern, ok := cond.Values[0].(string)
+			if !ok {
+				return "", nil, fmt.Errorf("like is not supported for %q", cond.Field)
+			}
+			params = append(params, likePattern(pattern))
+			query += ` AND ` + column + ` LIKE $` + strconv.Itoa(len(params)) + ` ESCAPE '\'`
+		default:
+			operator, ok := filterOperators[cond.Op]
+			if !ok {
+				return "", nil, fmt.Errorf("unknown filter operator %q", cond.Op)
+			}
+			params = append(params, cond.Values[0])
+			query += ` AND ` + column + ` ` + operator + ` $` + strconv.Itoa(len(params))
+		}
+	}
+	return query, params, nil
+}
+
+// likePattern turns shell style wildcards (* and ?) into a LIKE pattern,
+// escaping the characters LIKE treats specially.
+func likePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', '%', '_':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case '*':
+			b.WriteRune('%')
+		case '?':
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// appendCursor adds the keyset condition that skips every row up to and
+// including the one the cursor points at. For sort (a, -b) it produces
+// (a > $1) OR (a = $1 AND b < $2) OR (a = $1 AND b = $2 AND id > $3).
+func appendCursor(query string, params []interface{}, sort []model.SortField, cursor *model.Cursor) (string, []interface{}, error) {
+	if len(cursor.Values) != len(sort) {
+		return "", nil, errors.New("cursor does not match the sort")
+	}
+	columns := make([]string, len(sort))
+	for i, field := range sort {
+		column, ok := documentFilterColumns[field.Field]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown sort field %q", field.Field)
+		}
+		columns[i] = column
+	}
+	var branches []string
+	for i := 0; i <= len(sort); i++ {
+		var conds []string
+		for j := 0; j < i; j++ {
+			params = append(params, cursor.Values[j])
+			conds = append(conds, columns[j]+` = $`+strconv.Itoa(len(params)))
+		}
+		if i < len(sort) {
+			operator := ">"
+			if sort[i].Desc {
+				operator = "<"
+			}
+			params = append(params, cursor.Values[i])
+			conds = append(conds, columns[i]+` `+operator+` $`+strconv.Itoa(len(params)))
+		} else {
+			params = append(params, cursor.ID)
+			conds = append(conds, `d.id > $`+strconv.Itoa(len(params)))
+		}
+		branches = append(branches, `(`+strings.Join(conds, ` AND `)+`)`)
+	}
+	return query + ` AND (` + strings.Join(branches, ` OR `) + `)`, params, nil
+}
+
+// appendOrder adds ORDER BY for the sort fields with the document ID as the
+// final tie breaker, which keeps keyset pagination stable.
+func appendOrder(query string, sort []model.SortField) (string, error) {
+	var order []string
+	for _, field := range sort {
+		column, ok := documentFilterColumns[field.Field]
+		if !ok {
+			return "", fmt.Errorf("unknown sort field %q", field.Field)
+		}
+		if field.Desc {
+			column += ` DESC`
+		}
+		order = append(order, column)
+	}
+	order = append(order, `d.id`)
+	return query + ` ORDER BY ` + strings.Join(order, `, `), nil
+}
@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lavatee/astraltest/internal/model"
+)
+
+type GroupsPostgres struct {
+	db *sqlx.DB
+}
+
+func NewGroupsPostgres(db *sqlx.DB) *GroupsPostgres {
+	return &GroupsPostgres{db: db}
+}
+
+func (r *GroupsPostgres) Create(ctx context.Context, group *model.Group) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `INSERT INTO groups (name) VALUES ($1) RETURNING group_id, created_at`
+	if err := tx.GetContext(ctx, group, query, group.Name); err != nil {
+		return conflict(err, "Group already exists")
+	}
+	for _, login := range group.Members {
+		if _, err := addMember(ctx, tx, group.Name, login); err != nil {
+			return notFound(err, "User "+login+" not found")
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *GroupsPostgres) GetAll(ctx context.Context) ([]*model.Group, error) {
+	var groups []*model.Group
+	query := `SELECT group_id, name, created_at FROM groups ORDER BY name`
+	if err := r.db.SelectContext(ctx, &groups, query); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (r *GroupsPostgres) GetByName(ctx context.Context, name string) (*model.Group, error) {
+	var group model.Group
+	query := `SELECT group_id, name, created_at FROM groups WHERE name = $1`
+	if err := r.db.GetContext(ctx, &group, query, name); err != nil {
+		return nil, notFound(err, "Group not found")
+	}
+	query = `SELECT u.login
+	FROM group_members m
+	JOIN users u ON u.user_id = m.user_id
+	WHERE m.group_id = $1
+	ORDER BY u.login`
+	if err := r.db.SelectContext(ctx, &group.Members, query, group.ID); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// Delete removes the group with its members and grants and returns the IDs
+// of the former members and of the documents that were shared with it.
+func (r *GroupsPostgres) Delete(ctx context.Context, name string) ([]int, []string, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	var members []int
+	query := `SELECT m.user_id
+	FROM group_members m
+	JOIN groups g ON g.group_id = m.group_id
+	WHERE g.name = $1`
+	if err := tx.SelectContext(ctx, &members, query, name); err != nil {
+		return nil, nil, err
+	}
+	var documents []string
+	query = `SELECT g.document_id
+	FROM document_grants g
+	JOIN groups gr ON gr.group_id = g.group_id
+	WHERE gr.name = $1`
+	if err := tx.SelectContext(ctx, &documents, query, name); err != nil {
+		return nil, nil, err
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM groups WHERE name = $1`, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+		if err == nil {
+			err = notFound(sql.ErrNoRows, "Group not found")
+		}
+		return nil, nil, err
+	}
+	return members, documents, tx.Commit()
+}
+
+// AddMember adds the user to the group and returns its ID.
+func (r *GroupsPostgres) AddMember(ctx context.Context, name, login string) (int, error) {
+	userID, err := addMember(ctx, r.db, name, login)
+	return userID, notFound(err, "Group or user not found")
+}
+
+func addMember(ctx context.Context, q sqlx.QueryerContext, name, login string) (int, error) {
+	var userID int
+	query := `INSERT INTO group_members (group_id, user_id)
+	SELECT g.group_id, u.user_id FROM groups g, users u
+	WHERE g.name = $1 AND u.login = $2
+	ON CONFLICT (group_id, user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+	RETURNING user_id`
+	err := sqlx.GetContext(ctx, q, &userID, query, name, login)
+	return userID, err
+}
+
+// RemoveMember removes the user from the group and returns its ID.
+func (r *GroupsPostgres) RemoveMember(ctx context.Context, name, login string) (int, error) {
+	var userID int
+	query := `DELETE FROM group_members m
+	USING groups g, users u
+	WHERE m.group_id = g.group_id AND m.user_id = u.user_id AND g.name = $1 AND u.login = $2
+	RETURNING m.user_id`
+	err := r.db.GetContext(ctx, &userID, query, name, login)
+	return userID, notFound(err, "Group member not found")
+}
+
+func (r *GroupsPostgres) GetUserGroupIDs(ctx context.Context, userID int) ([]int, error) {
+	var ids []int
+	query := `SELECT group_id FROM group_members WHERE user_id = $1 ORDER BY group_id`
+	err := r.db.SelectContext(ctx, &ids, query, userID)
+	return ids, err
+}
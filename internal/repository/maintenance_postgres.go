@@ -0,0 +1,166 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// orphanBatch is the number of blob keys looked up in one query.
+const orphanBatch = 500
+
+type MaintenancePostgres struct {
+	db    *sqlx.DB
+	blobs BlobStore
+}
+
+func NewMaintenancePostgres(db *sqlx.DB, blobs BlobStore) *MaintenancePostgres {
+	return &MaintenancePostgres{db: db, blobs: blobs}
+}
+
+// RunExclusive runs the job unless another replica holds its advisory lock or
+// has started it less than interval ago. The lock is held by a transaction
+// for the duration of the run, so it is released even if the process dies.
+// It reports whether the job has been run.
+func (r *MaintenancePostgres) RunExclusive(ctx context.Context, job string, interval time.Duration, run func(ctx context.Context) (int64, error)) (bool, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var locked bool
+	if err := tx.GetContext(ctx, &locked, `SELECT pg_try_advisory_xact_lock(hashtext('janitor:' || $1))`, job); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	// Tickers of the replicas are not aligned, allow some slack so that a
+	// replica ticking slightly early does not skip a whole interval.
+	var recent bool
+	query := `SELECT EXISTS(
+	SELECT 1 FROM janitor_runs
+	WHERE job = $1 AND started_at > NOW() - make_interval(secs => $2)
+	)`
+	if err := tx.GetContext(ctx, &recent, query, job, (interval - interval/10).Seconds()); err != nil {
+		return false, err
+	}
+	if recent {
+		return false, nil
+	}
+	started := time.Now()
+	removed, runErr := run(ctx)
+	var lastError *string
+	failures := 0
+	if runErr != nil {
+		message := runErr.Error()
+		lastError = &message
+		failures = 1
+	}
+	query = `INSERT INTO janitor_runs (job, started_at, finished_at, duration_ms, removed, runs, failures, last_error)
+	VALUES ($1, $2, NOW(), $3, $4, 1, $5, $6)
+	ON CONFLICT (job) DO UPDATE SET started_at = $2, finished_at = NOW(), duration_ms = $3, removed = $4,
+	runs = janitor_runs.runs + 1, failures = janitor_runs.failures + $5, last_error = $6`
+	_, err = tx.ExecContext(ctx, query,
+		job, started, time.Since(started).Milliseconds(), removed, failures, lastError)
+	if err != nil {
+		return true, err
+	}
+	if err := tx.Commit(); err != nil {
+		return true, err
+	}
+	return true, runErr
+}
+
+// PurgeSessions deletes expired refresh tokens and expired sessions that can
+// not be refreshed any more.
+func (r *MaintenancePostgres) PurgeSessions(ctx context.Context) (int64, error) {
+	query := `DELETE FROM sessions s
+	WHERE s.expires_at < NOW() AND NOT EXISTS (
+	SELECT 1 FROM refresh_tokens t
+	WHERE t.family_id = s.family_id AND t.used_at IS NULL AND t.revoked_at IS NULL AND t.expires_at > NOW()
+	)`
+	res, err := r.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	sessions, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	res, err = r.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE expires_at < NOW()`)
+	if err != nil {
+		return sessions, err
+	}
+	tokens, err := res.RowsAffected()
+	return sessions + tokens, err
+}
+
+// PurgeOrphanRows deletes content rows whose document no longer exists.
+func (r *MaintenancePostgres) PurgeOrphanRows(ctx context.Context) (int64, error) {
+	var removed int64
+	for _, query := range []string{
+		`DELETE FROM document_data c WHERE NOT EXISTS (SELECT 1 FROM documents d WHERE d.id = c.document_id)`,
+		`DELETE FROM document_files c WHERE NOT EXISTS (SELECT 1 FROM documents d WHERE d.id = c.document_id)`,
+		`DELETE FROM document_versions c WHERE NOT EXISTS (SELECT 1 FROM documents d WHERE d.id = c.document_id)`,
+	} {
+		res, err := r.db.ExecContext(ctx, query)
+		if err != nil {
+			return removed, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+		removed += rows
+	}
+	return removed, nil
+}
+
+// PurgeOrphanBlobs deletes blobs that no document or revision refers to.
+// Blobs younger than grace are kept: uploads store the blob before the
+// transaction referencing it commits.
+func (r *MaintenancePostgres) PurgeOrphanBlobs(ctx context.Context, grace time.Duration) (int64, error) {
+	var removed int64
+	var batch []string
+	flush := func() error {
+		orphans, err := r.orphanKeys(ctx, batch)
+		batch = batch[:0]
+		if err != nil {
+			return err
+		}
+		for _, key := range orphans {
+			if err := r.blobs.Delete(ctx, key); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	}
+	cutoff := time.Now().Add(-grace)
+	err := r.blobs.Walk(ctx, func(info *BlobInfo) error {
+		if info.ModTime.After(cutoff) {
+			return nil
+		}
+		batch = append(batch, info.Key)
+		if len(batch) < orphanBatch {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	return removed, err
+}
+
+func (r *MaintenancePostgres) orphanKeys(ctx context.Context, keys []string) ([]string, error) {
+	var orphans []string
+	query := `SELECT k FROM unnest($1::text[]) k
+	WHERE NOT EXISTS (SELECT 1 FROM document_files f WHERE f.blob_key = k)
+	AND NOT EXISTS (SELECT 1 FROM document_versions v WHERE v.blob_key = k)`
+	err := r.db.SelectContext(ctx, &orphans, query, pq.Array(keys))
+	return orphans, err
+}
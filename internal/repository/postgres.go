@@ -1,11 +1,18 @@
 package repository
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lavatee/astraltest/internal/apperror"
+	"github.com/lib/pq"
 )
 
+// uniqueViolation is the Postgres error code of unique constraint failures.
+const uniqueViolation = "23505"
+
 type PostgresConfig struct {
 	Host     string
 	Port     string
@@ -25,3 +32,22 @@ func NewPostgresDB(config PostgresConfig) (*sqlx.DB, error) {
 	}
 	return db, nil
 }
+
+// notFound reports sql.ErrNoRows as a NotFound error with the text and
+// returns other errors as they are.
+func notFound(err error, text string) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return apperror.Wrap(apperror.NotFound, text, err)
+	}
+	return err
+}
+
+// conflict reports unique constraint failures as a Conflict error with the
+// text and returns other errors as they are.
+func conflict(err error, text string) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return apperror.Wrap(apperror.Conflict, text, err)
+	}
+	return err
+}
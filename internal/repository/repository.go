@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -9,30 +10,78 @@ import (
 )
 
 type Documents interface {
-	Create(ctx context.Context, token string, doc *model.Document, jsonData string, fileData []byte) error
-	GetAll(ctx context.Context, token, login, key, value string, limit int) ([]*model.Document, error)
-	GetByID(ctx context.Context, token, id string) (*model.Document, []byte, error)
-	GetFileData(ctx context.Context, token, id string) ([]byte, error)
-	Delete(ctx context.Context, token, id string) error
+	Create(ctx context.Context, userID int, doc *model.Document, jsonData string, file io.Reader) error
+	GetAll(ctx context.Context, userID int, query model.DocumentQuery) ([]*model.Document, error)
+	Count(ctx context.Context, userID int, query model.DocumentQuery) (int, error)
+	GetByID(ctx context.Context, userID int, id string) (*model.Document, io.ReadCloser, error)
+	GetFileData(ctx context.Context, userID int, id string) (io.ReadCloser, error)
+	GetMeta(ctx context.Context, id string) (*model.Document, error)
+	GetACL(ctx context.Context, id string) (*model.DocumentACL, error)
+	Update(ctx context.Context, userID int, doc *model.Document, jsonData string, file io.Reader) error
+	GetVersions(ctx context.Context, userID int, id string) ([]*model.DocumentVersion, error)
+	GetVersion(ctx context.Context, userID int, id string, version int) (*model.DocumentVersion, io.ReadCloser, error)
+	RestoreVersion(ctx context.Context, userID int, id string, version int) (*model.Document, error)
+	Delete(ctx context.Context, userID int, id string) error
+	Patch(ctx context.Context, userID int, id string, patch model.DocumentPatch) (*model.Document, error)
+	AddGrant(ctx context.Context, userID int, id string, grant model.GrantRequest) (*model.Document, error)
+	RevokeGrant(ctx context.Context, userID int, id string, grant model.GrantRequest) (*model.Document, error)
+	GetOwner(ctx context.Context, id string) (int, error)
+	IsPublic(ctx context.Context, id string) (bool, error)
+	GetOwnedIDs(ctx context.Context, userID int) ([]string, error)
+	GetAudience(ctx context.Context, id string) ([]int, error)
+}
+
+type Groups interface {
+	Create(ctx context.Context, group *model.Group) error
+	GetAll(ctx context.Context) ([]*model.Group, error)
+	GetByName(ctx context.Context, name string) (*model.Group, error)
+	Delete(ctx context.Context, name string) ([]int, []string, error)
+	AddMember(ctx context.Context, name, login string) (int, error)
+	RemoveMember(ctx context.Context, name, login string) (int, error)
+	GetUserGroupIDs(ctx context.Context, userID int) ([]int, error)
 }
 
 type Users interface {
 	Create(ctx context.Context, req model.RegisterRequest) (string, error)
-	GetByCredentials(ctx context.Context, login, password string) (*model.User, error)
-	CreateSession(ctx context.Context, userID int, token string, expiresAt time.Time) error
+	GetByLogin(ctx context.Context, login string) (*model.User, error)
+	UpdatePassword(ctx context.Context, userID int, passwordHash string) error
+	CreateSession(ctx context.Context, session *model.Session) error
 	DeleteSession(ctx context.Context, token string) error
-	ValidateToken(ctx context.Context, token string) (bool, error)
+	GetSession(ctx context.Context, token string) (*model.Session, error)
+	CreateRefreshToken(ctx context.Context, token *model.RefreshToken) error
+	GetRefreshToken(ctx context.Context, hash string) (*model.RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, hash string, next *model.RefreshToken, session *model.Session) (string, error)
+	RevokeTokenFamily(ctx context.Context, familyID string) ([]string, error)
+	GetSessions(ctx context.Context, userID int) ([]*model.Session, error)
+	GetSessionByID(ctx context.Context, userID, id int) (*model.Session, error)
+	TouchSession(ctx context.Context, token string) error
+	RevokeUserSessions(ctx context.Context, userID int, exceptToken string) ([]string, error)
 	GetByID(ctx context.Context, id int) (*model.User, error)
+	SetRoles(ctx context.Context, userID int, roles []string) error
+	GetAll(ctx context.Context) ([]*model.User, error)
+	SetDisabled(ctx context.Context, userID int, disabled bool) error
+	Delete(ctx context.Context, userID, transferTo int) ([]string, error)
+}
+
+type Maintenance interface {
+	RunExclusive(ctx context.Context, job string, interval time.Duration, run func(ctx context.Context) (int64, error)) (bool, error)
+	PurgeSessions(ctx context.Context) (int64, error)
+	PurgeOrphanRows(ctx context.Context) (int64, error)
+	PurgeOrphanBlobs(ctx context.Context, grace time.Duration) (int64, error)
 }
 
 type Repository struct {
 	Documents
 	Users
+	Groups
+	Maintenance
 }
 
-func NewRepository(db *sqlx.DB) *Repository {
+func NewRepository(db *sqlx.DB, blobs BlobStore) *Repository {
 	return &Repository{
-		Documents: NewDocumentsPostgres(db),
-		Users:     NewUsersPostgres(db),
+		Documents:   NewDocumentsPostgres(db, blobs),
+		Users:       NewUsersPostgres(db),
+		Groups:      NewGroupsPostgres(db),
+		Maintenance: NewMaintenancePostgres(db, blobs),
 	}
 }
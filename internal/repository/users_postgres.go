@@ -3,10 +3,10 @@ package repository
 import (
 	"context"
 	"database/sql"
-	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lavatee/astraltest/internal/model"
+	"github.com/lib/pq"
 )
 
 type UsersPostgres struct {
@@ -18,33 +18,69 @@ func NewUsersPostgres(db *sqlx.DB) *UsersPostgres {
 }
 
 func (r *UsersPostgres) Create(ctx context.Context, req model.RegisterRequest) (string, error) {
-	query := `INSERT INTO users (login, password_hash) VALUES ($1, $2)`
-	_, err := r.db.ExecContext(ctx, query, req.Login, req.Pswd)
+	tx, err := r.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return "", err
 	}
-	return req.Login, err
+	defer tx.Rollback()
+	var userID int
+	query := `INSERT INTO users (login, password_hash) VALUES ($1, $2) RETURNING user_id`
+	if err := tx.GetContext(ctx, &userID, query, req.Login, req.Pswd); err != nil {
+		return "", conflict(err, "User already exists")
+	}
+	if err := setRoles(ctx, tx, userID, req.Roles); err != nil {
+		return "", err
+	}
+	return req.Login, tx.Commit()
 }
 
-func (r *UsersPostgres) GetByCredentials(ctx context.Context, login, password string) (*model.User, error) {
+func (r *UsersPostgres) GetByLogin(ctx context.Context, login string) (*model.User, error) {
 	var user model.User
-	query := `SELECT user_id, login, password_hash 
-	FROM users 
-	WHERE login = $1 AND password_hash = $2`
-	err := r.db.GetContext(ctx, &user, query, login, password)
-	if err == sql.ErrNoRows {
+	query := `SELECT user_id, login, password_hash, disabled, created_at
+	FROM users
+	WHERE login = $1`
+	err := r.db.GetContext(ctx, &user, query, login)
+	if err != nil {
+		return nil, notFound(err, "User not found")
+	}
+	if user.Roles, err = getRoles(ctx, r.db, user.ID); err != nil {
 		return nil, err
 	}
-	return &user, err
+	return &user, nil
+}
+
+func (r *UsersPostgres) UpdatePassword(ctx context.Context, userID int, passwordHash string) error {
+	query := `UPDATE users SET password_hash = $1 WHERE user_id = $2`
+	_, err := r.db.ExecContext(ctx, query, passwordHash, userID)
+	return err
+}
+
+func (r *UsersPostgres) CreateSession(ctx context.Context, session *model.Session) error {
+	return createSession(ctx, r.db, session)
 }
 
-func (r *UsersPostgres) CreateSession(ctx context.Context, userID int, token string, expiresAt time.Time) error {
-	query := `INSERT INTO sessions (user_id, token, expires_at)
-	VALUES ($1, $2, $3)`
-	_, err := r.db.ExecContext(ctx, query, userID, token, expiresAt)
+func createSession(ctx context.Context, e sqlx.ExecerContext, session *model.Session) error {
+	query := `INSERT INTO sessions (user_id, token, family_id, ip, user_agent, expires_at, last_used_at)
+	VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), $6, NOW())`
+	_, err := e.ExecContext(ctx, query,
+		session.UserID, session.Token, session.FamilyID, session.IP, session.UserAgent, session.ExpiresAt)
 	return err
 }
 
+// rotateSession replaces the access token of the family's session and
+// returns the previous one.
+func rotateSession(ctx context.Context, q sqlx.QueryerContext, session *model.Session) (string, error) {
+	var previous string
+	query := `UPDATE sessions s SET token = $2, expires_at = $3, last_used_at = NOW(),
+	ip = COALESCE(NULLIF($4, ''), s.ip), user_agent = COALESCE(NULLIF($5, ''), s.user_agent)
+	FROM sessions old
+	WHERE old.session_id = s.session_id AND s.family_id = $1
+	RETURNING old.token`
+	err := sqlx.GetContext(ctx, q, &previous, query,
+		session.FamilyID, session.Token, session.ExpiresAt, session.IP, session.UserAgent)
+	return previous, err
+}
+
 func (r *UsersPostgres) DeleteSession(ctx context.Context, token string) error {
 	query := `DELETE FROM sessions 
 	WHERE token = $1`
@@ -52,23 +88,279 @@ func (r *UsersPostgres) DeleteSession(ctx context.Context, token string) error {
 	return err
 }
 
-func (r *UsersPostgres) ValidateToken(ctx context.Context, token string) (bool, error) {
-	var exists bool
-	query := `SELECT EXISTS(
-	SELECT 1 FROM sessions 
-	WHERE token = $1 AND expires_at > NOW())`
-	err := r.db.GetContext(ctx, &exists, query, token)
-	return exists, err
+func (r *UsersPostgres) GetSession(ctx context.Context, token string) (*model.Session, error) {
+	var session model.Session
+	query := `SELECT s.session_id, s.token, s.user_id, u.login, COALESCE(s.family_id, '') AS family_id, s.expires_at
+	FROM sessions s
+	JOIN users u ON u.user_id = s.user_id
+	WHERE s.token = $1 AND s.expires_at > NOW() AND NOT u.disabled`
+	err := r.db.GetContext(ctx, &session, query, token)
+	if err != nil {
+		return nil, notFound(err, "Session not found")
+	}
+	if session.Roles, err = getRoles(ctx, r.db, session.UserID); err != nil {
+		return nil, err
+	}
+	return &session, nil
 }
 
 func (r *UsersPostgres) GetByID(ctx context.Context, id int) (*model.User, error) {
-	query := `SELECT user_id, login, password_hash
+	query := `SELECT user_id, login, password_hash, disabled, created_at
 	FROM users
 	WHERE user_id = $1`
 	var user model.User
 	err := r.db.GetContext(ctx, &user, query, id)
-	if err == sql.ErrNoRows {
+	if err != nil {
+		return nil, notFound(err, "User not found")
+	}
+	if user.Roles, err = getRoles(ctx, r.db, user.ID); err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
+
+func (r *UsersPostgres) SetRoles(ctx context.Context, userID int, roles []string) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_roles WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if err := setRoles(ctx, tx, userID, roles); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type userRow struct {
+	model.User
+	Roles pq.StringArray `db:"roles"`
+}
+
+func (r *UsersPostgres) GetAll(ctx context.Context) ([]*model.User, error) {
+	var rows []userRow
+	query := `SELECT u.user_id, u.login, u.password_hash, u.disabled, u.created_at,
+	COALESCE(array_agg(r.role ORDER BY r.role) FILTER (WHERE r.role IS NOT NULL), '{}') AS roles
+	FROM users u
+	LEFT JOIN user_roles r ON r.user_id = u.user_id
+	GROUP BY u.user_id
+	ORDER BY u.login`
+	if err := r.db.SelectContext(ctx, &rows, query); err != nil {
+		return nil, err
+	}
+	users := make([]*model.User, 0, len(rows))
+	for i := range rows {
+		user := rows[i].User
+		user.Roles = rows[i].Roles
+		users = append(users, &user)
+	}
+	return users, nil
+}
+
+func (r *UsersPostgres) SetDisabled(ctx context.Context, userID int, disabled bool) error {
+	query := `UPDATE users SET disabled = $1 WHERE user_id = $2`
+	_, err := r.db.ExecContext(ctx, query, disabled, userID)
+	return err
+}
+
+// Delete removes the user with its sessions, refresh tokens and grants. The
+// documents it owns are given to transferTo, unless it is zero: then they
+// must have been deleted before. It returns the deleted access tokens.
+func (r *UsersPostgres) Delete(ctx context.Context, userID, transferTo int) ([]string, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if transferTo != 0 {
+		query := `UPDATE documents SET owner_id = $1 WHERE owner_id = $2`
+		if _, err := tx.ExecContext(ctx, query, transferTo, userID); err != nil {
+			return nil, err
+		}
+		// Grants of the new owner on its documents mean nothing any more.
+		query = `DELETE FROM document_grants g USING documents d
+		WHERE g.document_id = d.id AND d.owner_id = $1 AND g.user_id = $1`
+		if _, err := tx.ExecContext(ctx, query, transferTo); err != nil {
+			return nil, err
+		}
+	}
+	var tokens []string
+	if err := tx.SelectContext(ctx, &tokens, `DELETE FROM sessions WHERE user_id = $1 RETURNING token`, userID); err != nil {
+		return nil, err
+	}
+	for _, query := range []string{
+		`DELETE FROM refresh_tokens WHERE user_id = $1`,
+		`DELETE FROM document_grants WHERE user_id = $1`,
+		`DELETE FROM users WHERE user_id = $1`,
+	} {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, tx.Commit()
+}
+
+func getRoles(ctx context.Context, q sqlx.QueryerContext, userID int) ([]string, error) {
+	var roles []string
+	query := `SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role`
+	err := sqlx.SelectContext(ctx, q, &roles, query, userID)
+	return roles, err
+}
+
+func setRoles(ctx context.Context, e sqlx.ExecerContext, userID int, roles []string) error {
+	query := `INSERT INTO user_roles (user_id, role) VALUES ($1, $2)
+	ON CONFLICT DO NOTHING`
+	for _, role := range roles {
+		if _, err := e.ExecContext(ctx, query, userID, role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *UsersPostgres) CreateRefreshToken(ctx context.Context, token *model.RefreshToken) error {
+	return createRefreshToken(ctx, r.db, token)
+}
+
+func createRefreshToken(ctx context.Context, q sqlx.QueryerContext, token *model.RefreshToken) error {
+	query := `INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+	VALUES ($1, $2, $3, $4)
+	RETURNING token_id`
+	return sqlx.GetContext(ctx, q, &token.ID, query, token.UserID, token.FamilyID, token.Hash, token.ExpiresAt)
+}
+
+func (r *UsersPostgres) GetRefreshToken(ctx context.Context, hash string) (*model.RefreshToken, error) {
+	var token model.RefreshToken
+	query := `SELECT token_id, user_id, family_id, token_hash, expires_at, used_at, revoked_at
+	FROM refresh_tokens
+	WHERE token_hash = $1`
+	if err := r.db.GetContext(ctx, &token, query, hash); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RotateRefreshToken marks the refresh token as used, stores its successor
+// and moves the family's session to a new access token. The user and family
+// of next and session are taken from the used token. It returns the replaced
+// access token, if any. sql.ErrNoRows means the refresh token is unknown,
+// expired, revoked or was already used.
+func (r *UsersPostgres) RotateRefreshToken(ctx context.Context, hash string, next *model.RefreshToken, session *model.Session) (string, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var used model.RefreshToken
+	query := `UPDATE refresh_tokens SET used_at = NOW()
+	WHERE token_hash = $1 AND used_at IS NULL AND revoked_at IS NULL AND expires_at > NOW()
+	AND NOT EXISTS (SELECT 1 FROM users u WHERE u.user_id = refresh_tokens.user_id AND u.disabled)
+	RETURNING token_id, user_id, family_id, token_hash, expires_at, used_at, revoked_at`
+	if err := tx.GetContext(ctx, &used, query, hash); err != nil {
+		return "", err
+	}
+	next.UserID, next.FamilyID = used.UserID, used.FamilyID
+	session.UserID, session.FamilyID = used.UserID, used.FamilyID
+	if err := createRefreshToken(ctx, tx, next); err != nil {
+		return "", err
+	}
+	previous, err := rotateSession(ctx, tx, session)
+	if err == sql.ErrNoRows {
+		err = createSession(ctx, tx, session)
+	}
+	if err != nil {
+		return "", err
+	}
+	return previous, tx.Commit()
+}
+
+// RevokeTokenFamily revokes every refresh token of the family and deletes its
+// access sessions. It returns the deleted access tokens so that callers can
+// evict them from caches.
+func (r *UsersPostgres) RevokeTokenFamily(ctx context.Context, familyID string) ([]string, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query := `UPDATE refresh_tokens SET revoked_at = NOW()
+	WHERE family_id = $1 AND revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, familyID); err != nil {
+		return nil, err
+	}
+	var tokens []string
+	query = `DELETE FROM sessions WHERE family_id = $1 RETURNING token`
+	if err := tx.SelectContext(ctx, &tokens, query, familyID); err != nil {
+		return nil, err
+	}
+	return tokens, tx.Commit()
+}
+
+// GetSessions returns the sessions of the user that can still be used, either
+// directly or through their refresh token.
+func (r *UsersPostgres) GetSessions(ctx context.Context, userID int) ([]*model.Session, error) {
+	var sessions []*model.Session
+	query := `SELECT * FROM (
+	SELECT s.session_id, s.token, s.user_id, COALESCE(s.family_id, '') AS family_id,
+	COALESCE(s.ip, '') AS ip, COALESCE(s.user_agent, '') AS user_agent, s.created_at, s.last_used_at,
+	GREATEST(s.expires_at, (
+	SELECT MAX(t.expires_at) FROM refresh_tokens t
+	WHERE t.family_id = s.family_id AND t.used_at IS NULL AND t.revoked_at IS NULL
+	)) AS expires_at
+	FROM sessions s
+	WHERE s.user_id = $1
+	) sessions
+	WHERE expires_at > NOW()
+	ORDER BY COALESCE(last_used_at, created_at) DESC, session_id DESC`
+	if err := r.db.SelectContext(ctx, &sessions, query, userID); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (r *UsersPostgres) GetSessionByID(ctx context.Context, userID, id int) (*model.Session, error) {
+	var session model.Session
+	query := `SELECT session_id, token, user_id, COALESCE(family_id, '') AS family_id, expires_at
+	FROM sessions
+	WHERE session_id = $1 AND user_id = $2`
+	if err := r.db.GetContext(ctx, &session, query, id, userID); err != nil {
+		return nil, notFound(err, "Session not found")
+	}
+	return &session, nil
+}
+
+func (r *UsersPostgres) TouchSession(ctx context.Context, token string) error {
+	query := `UPDATE sessions SET last_used_at = NOW() WHERE token = $1`
+	_, err := r.db.ExecContext(ctx, query, token)
+	return err
+}
+
+// RevokeUserSessions deletes every session of the user except the one of
+// exceptToken (which may be empty) and revokes their refresh tokens. It
+// returns the deleted access tokens.
+func (r *UsersPostgres) RevokeUserSessions(ctx context.Context, userID int, exceptToken string) ([]string, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	query := `UPDATE refresh_tokens SET revoked_at = NOW()
+	WHERE user_id = $1 AND revoked_at IS NULL AND family_id NOT IN (
+	SELECT family_id FROM sessions WHERE token = $2 AND family_id IS NOT NULL
+	)`
+	if _, err := tx.ExecContext(ctx, query, userID, exceptToken); err != nil {
+		return nil, err
+	}
+	var tokens []string
+	query = `DELETE FROM sessions
+	WHERE user_id = $1 AND token <> $2 AND COALESCE(family_id, '') NOT IN (
+	SELECT family_id FROM sessions WHERE token = $2 AND family_id IS NOT NULL
+	)
+	RETURNING token`
+	if err := tx.SelectContext(ctx, &tokens, query, userID, exceptToken); err != nil {
+		return nil, err
+	}
+	return tokens, tx.Commit()
+}
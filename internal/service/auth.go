@@ -2,64 +2,335 @@ package service
 
 import (
 	"context"
-	"crypto/sha1"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lavatee/astraltest/internal/apperror"
 	"github.com/lavatee/astraltest/internal/model"
 	"github.com/lavatee/astraltest/internal/repository"
+	"github.com/sirupsen/logrus"
 )
 
-const (
-	salt = "2ru035c3x3w25"
+var (
+	ErrUnauthorized        = apperror.New(apperror.Unauthorized, "Invalid credentials")
+	ErrInvalidToken        = apperror.New(apperror.Unauthorized, "Invalid token")
+	ErrInvalidRefreshToken = apperror.New(apperror.Unauthorized, "Invalid refresh token")
+	ErrInvalidAdminToken   = apperror.New(apperror.Forbidden, "Invalid admin token")
+	ErrWrongPassword       = apperror.New(apperror.Validation, "Current password is wrong")
 )
 
+type SessionConfig struct {
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
 type AuthService struct {
 	repo       *repository.Repository
 	adminToken string
+	passwords  *PasswordHasher
+	sessions   SessionConfig
+	cache      Cache
 }
 
-func NewAuthService(repo *repository.Repository, adminToken string) *AuthService {
+func NewAuthService(repo *repository.Repository, adminToken string, passwords *PasswordHasher, sessions SessionConfig, cache Cache) *AuthService {
+	if sessions.AccessTTL <= 0 {
+		sessions.AccessTTL = 15 * time.Minute
+	}
+	if sessions.RefreshTTL <= 0 {
+		sessions.RefreshTTL = 30 * 24 * time.Hour
+	}
 	return &AuthService{
 		repo:       repo,
 		adminToken: adminToken,
+		passwords:  passwords,
+		sessions:   sessions,
+		cache:      cache,
 	}
 }
 
 func (s *AuthService) Register(ctx context.Context, req model.RegisterRequest) (string, error) {
 	if req.Token != s.adminToken {
-		return "", errors.New("invalid admin token")
+		return "", ErrInvalidAdminToken
+	}
+	hash, err := s.passwords.Hash(req.Pswd)
+	if err != nil {
+		return "", err
+	}
+	req.Pswd = hash
+	if len(req.Roles) == 0 {
+		req.Roles = model.DefaultRoles
+	}
+	if err := validateRoles(req.Roles); err != nil {
+		return "", err
 	}
-	req.Pswd = s.hashPassword(req.Pswd)
 	return s.repo.Users.Create(ctx, req)
 }
 
-func (s *AuthService) hashPassword(password string) string {
-	sha := sha1.New()
-	sha.Write([]byte(password))
-	return fmt.Sprintf("%x", sha.Sum([]byte(salt)))
+func (s *AuthService) Authenticate(ctx context.Context, req model.AuthRequest, client model.ClientInfo) (*model.Tokens, error) {
+	user, err := s.repo.Users.GetByLogin(ctx, req.Login)
+	if err != nil {
+		s.passwords.VerifyDummy(req.Pswd)
+		if apperror.KindOf(err) == apperror.NotFound {
+			return nil, ErrUnauthorized
+		}
+		return nil, err
+	}
+	if !s.passwords.Verify(req.Pswd, user.Password) || user.Disabled {
+		return nil, ErrUnauthorized
+	}
+	if s.passwords.NeedsRehash(user.Password) {
+		s.rehash(ctx, user, req.Pswd)
+	}
+	tokens, session, refresh, err := s.newTokens(user.ID, uuid.New().String(), client)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.Users.CreateRefreshToken(ctx, refresh); err != nil {
+		return nil, err
+	}
+	if err := s.repo.Users.CreateSession(ctx, session); err != nil {
+		return nil, err
+	}
+	return tokens, nil
 }
 
-func (s *AuthService) Authenticate(ctx context.Context, req model.AuthRequest) (string, error) {
-	req.Pswd = s.hashPassword(req.Pswd)
-	user, err := s.repo.Users.GetByCredentials(ctx, req.Login, req.Pswd)
+// Refresh exchanges a refresh token for a new access token and a new refresh
+// token of the same family. The old refresh token can not be used again.
+func (s *AuthService) Refresh(ctx context.Context, refreshToken string, client model.ClientInfo) (*model.Tokens, error) {
+	tokens, session, next, err := s.newTokens(0, "", client)
 	if err != nil {
-		return "", errors.New("unauthorized")
+		return nil, err
 	}
-	token := uuid.New().String()
-	expiresAt := time.Now().Add(24 * time.Hour)
-	if err := s.repo.Users.CreateSession(ctx, user.ID, token, expiresAt); err != nil {
-		return "", err
+	hash := hashToken(refreshToken)
+	previous, err := s.repo.Users.RotateRefreshToken(ctx, hash, next, session)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.detectReuse(ctx, hash)
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if previous != "" {
+		if err := s.evictSessions(ctx, []string{previous}); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// detectReuse revokes the whole family when an already rotated refresh token
+// is presented again: someone holds a copy of it, and there is no telling
+// whether it is the client or an attacker.
+func (s *AuthService) detectReuse(ctx context.Context, hash string) {
+	token, err := s.repo.Users.GetRefreshToken(ctx, hash)
+	if err != nil || token.UsedAt == nil || token.RevokedAt != nil {
+		return
+	}
+	logrus.Warnf("Refresh token reuse detected for user %d, revoking token family %s", token.UserID, token.FamilyID)
+	if err := s.revokeFamily(ctx, token.FamilyID); err != nil {
+		logrus.Errorf("Failed to revoke token family %s: %s", token.FamilyID, err.Error())
+	}
+}
+
+func (s *AuthService) revokeFamily(ctx context.Context, familyID string) error {
+	tokens, err := s.repo.Users.RevokeTokenFamily(ctx, familyID)
+	if err != nil {
+		return err
+	}
+	return s.evictSessions(ctx, tokens)
+}
+
+// evictSessions drops the cached principals of ended sessions. It fails if
+// the cache could not be reached, since they would authenticate until they
+// expire otherwise.
+func (s *AuthService) evictSessions(ctx context.Context, tokens []string) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		keys = append(keys, "session:"+token)
+	}
+	return deleteStrict(ctx, s.cache, keys...)
+}
+
+// newTokens generates an access and a refresh token with their lifetimes.
+func (s *AuthService) newTokens(userID int, familyID string, client model.ClientInfo) (*model.Tokens, *model.Session, *model.RefreshToken, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, nil, err
+	}
+	now := time.Now()
+	tokens := &model.Tokens{
+		AccessToken:      uuid.New().String(),
+		ExpiresAt:        now.Add(s.sessions.AccessTTL),
+		RefreshToken:     base64.RawURLEncoding.EncodeToString(secret),
+		RefreshExpiresAt: now.Add(s.sessions.RefreshTTL),
+	}
+	session := &model.Session{
+		Token:     tokens.AccessToken,
+		UserID:    userID,
+		FamilyID:  familyID,
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		ExpiresAt: tokens.ExpiresAt,
+	}
+	refresh := &model.RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		Hash:      hashToken(tokens.RefreshToken),
+		ExpiresAt: tokens.RefreshExpiresAt,
+	}
+	return tokens, session, refresh, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// rehash upgrades a legacy or outdated hash after a successful login. It
+// does not fail the login: the old hash keeps working until the next try.
+func (s *AuthService) rehash(ctx context.Context, user *model.User, password string) {
+	hash, err := s.passwords.Hash(password)
+	if err == nil {
+		err = s.repo.Users.UpdatePassword(ctx, user.ID, hash)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to rehash password of user %d: %s", user.ID, err.Error())
+	}
+}
+
+// ValidateToken resolves the token into a principal. Sessions are cached in
+// until they expire, so most requests never touch the sessions table.
+func (s *AuthService) ValidateToken(ctx context.Context, token string) (*model.Principal, error) {
+	cacheKey := "session:" + token
+	if cached, err := s.cache.Get(ctx, cacheKey); err == nil {
+		var principal model.Principal
+		// Principals cached before roles existed have none, reload them.
+		if err := json.Unmarshal(cached, &principal); err == nil && len(principal.Roles) > 0 {
+			s.touchSession(ctx, token)
+			return &principal, nil
+		}
+	}
+	session, err := s.repo.Users.GetSession(ctx, token)
+	if apperror.KindOf(err) == apperror.NotFound {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	principal := &model.Principal{
+		UserID: session.UserID,
+		Login:  session.Login,
+		Roles:  session.Roles,
 	}
-	return token, nil
+	if ttl := time.Until(session.ExpiresAt); ttl > 0 {
+		if data, err := json.Marshal(principal); err == nil {
+			s.cache.Set(ctx, cacheKey, data, ttl)
+		}
+	}
+	s.touchSession(ctx, token)
+	return principal, nil
 }
 
-func (s *AuthService) ValidateToken(ctx context.Context, token string) (bool, error) {
-	return s.repo.Users.ValidateToken(ctx, token)
+// touchSession records the last use of a session at most once a minute, so
+// that cached requests do not turn into a write each.
+func (s *AuthService) touchSession(ctx context.Context, token string) {
+	touchedKey := "session:touched:" + token
+	if _, err := s.cache.Get(ctx, touchedKey); err == nil {
+		return
+	}
+	s.cache.Set(ctx, touchedKey, []byte("1"), time.Minute)
+	if err := s.repo.Users.TouchSession(ctx, token); err != nil {
+		logrus.Errorf("Failed to update session last use: %s", err.Error())
+	}
 }
 
-func (s *AuthService) Logout(ctx context.Context, token string) error {
-	return s.repo.Users.DeleteSession(ctx, token)
+// Logout ends the session of the principal and, for sessions issued
+// together with a refresh token, revokes the refresh token as well. Sessions
+// of other users are left alone.
+func (s *AuthService) Logout(ctx context.Context, principal *model.Principal, token string) error {
+	session, err := s.repo.Users.GetSession(ctx, token)
+	if err != nil {
+		return err
+	}
+	if session.UserID != principal.UserID {
+		return fmt.Errorf("%w: session of user %d", ErrForbidden, session.UserID)
+	}
+	if session.FamilyID != "" {
+		return s.revokeFamily(ctx, session.FamilyID)
+	}
+	if err := s.repo.Users.DeleteSession(ctx, token); err != nil {
+		return err
+	}
+	return s.evictSessions(ctx, []string{token})
+}
+
+// GetSessions lists the sessions of the principal, marking the one of
+// currentToken.
+func (s *AuthService) GetSessions(ctx context.Context, principal *model.Principal, currentToken string) ([]*model.Session, error) {
+	sessions, err := s.repo.Users.GetSessions(ctx, principal.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if sessions == nil {
+		sessions = []*model.Session{}
+	}
+	for _, session := range sessions {
+		session.Current = session.Token == currentToken
+	}
+	return sessions, nil
+}
+
+func (s *AuthService) RevokeSession(ctx context.Context, principal *model.Principal, id int) error {
+	session, err := s.repo.Users.GetSessionByID(ctx, principal.UserID, id)
+	if err != nil {
+		return err
+	}
+	if session.FamilyID != "" {
+		return s.revokeFamily(ctx, session.FamilyID)
+	}
+	if err := s.repo.Users.DeleteSession(ctx, session.Token); err != nil {
+		return err
+	}
+	return s.evictSessions(ctx, []string{session.Token})
+}
+
+// RevokeSessions logs the principal out everywhere, except for the session
+// of exceptToken when it is not empty.
+func (s *AuthService) RevokeSessions(ctx context.Context, principal *model.Principal, exceptToken string) error {
+	tokens, err := s.repo.Users.RevokeUserSessions(ctx, principal.UserID, exceptToken)
+	if err != nil {
+		return err
+	}
+	return s.evictSessions(ctx, tokens)
+}
+
+// ChangePassword sets a new password and ends every other session of the
+// principal.
+func (s *AuthService) ChangePassword(ctx context.Context, principal *model.Principal, currentToken string, req model.PasswordChangeRequest) error {
+	user, err := s.repo.Users.GetByID(ctx, principal.UserID)
+	if err != nil {
+		return err
+	}
+	if !s.passwords.Verify(req.Old, user.Password) {
+		return ErrWrongPassword
+	}
+	hash, err := s.passwords.Hash(req.New)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.Users.UpdatePassword(ctx, user.ID, hash); err != nil {
+		return err
+	}
+	return s.RevokeSessions(ctx, principal, currentToken)
 }
@@ -0,0 +1,227 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrCacheMiss = errors.New("cache miss")
+
+// Cache keeps short-lived copies of data that can be loaded again. Entries
+// may carry tags, and Invalidate drops every entry carrying one of the tags,
+// so callers do not need to know the keys that were derived from a piece of
+// data. Values returned by Get must not be modified.
+type Cache interface {
+	// Get fails with ErrCacheMiss when there is no entry for the key.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags ...string) error
+	Delete(ctx context.Context, keys ...string) error
+	Invalidate(ctx context.Context, tags ...string) error
+	Close() error
+}
+
+// Sweeper is implemented by caches that outlive the process and may hold
+// entries written by older versions.
+type Sweeper interface {
+	Sweep(ctx context.Context, patterns ...string) (int64, error)
+}
+
+// Budgeter is implemented by caches that can keep a class of entries, such
+// as document bodies, within a byte budget of its own.
+type Budgeter interface {
+	WithBudget(name string, maxBytes int64) Cache
+}
+
+// TagVersioner is implemented by caches that can refuse a value loaded
+// before one of its tags was invalidated, which would otherwise bring back
+// what the invalidation dropped.
+type TagVersioner interface {
+	// TagVersions returns the versions of the tags, which Invalidate
+	// advances. They are only meant to be passed to SetIfCurrent.
+	TagVersions(ctx context.Context, tags ...string) ([]int64, error)
+	// SetIfCurrent stores the entry like Set unless one of its tags was
+	// invalidated since the versions were read.
+	SetIfCurrent(ctx context.Context, key string, value []byte, ttl time.Duration, versions []int64, tags ...string) error
+}
+
+// StrictInvalidator is implemented by caches that hide their failures.
+// InvalidateStrict reports them, for invalidations that must not be lost.
+type StrictInvalidator interface {
+	InvalidateStrict(ctx context.Context, tags ...string) error
+}
+
+// invalidateStrict invalidates the tags, reporting failures even if the
+// cache hides them otherwise.
+func invalidateStrict(ctx context.Context, cache Cache, tags ...string) error {
+	if strict, ok := cache.(StrictInvalidator); ok {
+		return strict.InvalidateStrict(ctx, tags...)
+	}
+	return cache.Invalidate(ctx, tags...)
+}
+
+// StrictDeleter is implemented by caches that hide their failures.
+// DeleteStrict reports them, for entries that must not outlive their data.
+type StrictDeleter interface {
+	DeleteStrict(ctx context.Context, keys ...string) error
+}
+
+// deleteStrict deletes the keys, reporting failures even if the cache hides
+// them otherwise.
+func deleteStrict(ctx context.Context, cache Cache, keys ...string) error {
+	if strict, ok := cache.(StrictDeleter); ok {
+		return strict.DeleteStrict(ctx, keys...)
+	}
+	return cache.Delete(ctx, keys...)
+}
+
+// Subscriber is implemented by caches that follow invalidations of other
+// instances. Subscribe runs until ctx is done.
+type Subscriber interface {
+	Subscribe(ctx context.Context)
+}
+
+type CacheConfig struct {
+	// Type is "redis", "memory" for a cache local to the process, or
+	// "tiered" for a local cache in front of Redis.
+	Type   string
+	Redis  RedisConfig
+	Memory MemoryCacheConfig
+	// LocalTTL bounds how long the local tier of a tiered cache serves an
+	// entry whose invalidation by another instance has not arrived.
+	LocalTTL time.Duration
+}
+
+func NewCache(config CacheConfig) (Cache, error) {
+	switch config.Type {
+	case "", "redis":
+		return newResilientCache(NewRedisCache(NewRedisClient(config.Redis))), nil
+	case "memory":
+		return NewMemoryCache(config.Memory), nil
+	case "tiered":
+		client := NewRedisClient(config.Redis)
+		remote := newResilientCache(NewRedisCache(client))
+		return NewTieredCache(NewMemoryCache(config.Memory), remote, config.LocalTTL, NewCacheBus(client)), nil
+	default:
+		return nil, fmt.Errorf("unknown cache type: %s", config.Type)
+	}
+}
+
+// resilientCache turns failures of a shared cache into misses, so that an
+// outage makes requests go to the database instead of failing them. Entries
+// can not be invalidated during an outage, which is why TTLs stay short and
+// why changes of access invalidate with InvalidateStrict and evicted
+// sessions are deleted with DeleteStrict.
+type resilientCache struct {
+	cache Cache
+	down  atomic.Bool
+}
+
+func newResilientCache(cache Cache) *resilientCache {
+	return &resilientCache{cache: cache}
+}
+
+// check logs when the cache becomes unavailable and when it is back, rather
+// than every failed call.
+func (c *resilientCache) check(err error) error {
+	if err == nil || errors.Is(err, ErrCacheMiss) {
+		if c.down.CompareAndSwap(true, false) {
+			logrus.Info("Cache is available again")
+		}
+		return err
+	}
+	if c.down.CompareAndSwap(false, true) {
+		logrus.Errorf("Cache is unavailable, falling back to the database: %s", err.Error())
+	}
+	return nil
+}
+
+func (c *resilientCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.cache.Get(ctx, key)
+	if err = c.check(err); err != nil || value == nil {
+		return nil, ErrCacheMiss
+	}
+	return value, nil
+}
+
+func (c *resilientCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags ...string) error {
+	return c.check(c.cache.Set(ctx, key, value, ttl, tags...))
+}
+
+func (c *resilientCache) Delete(ctx context.Context, keys ...string) error {
+	return c.check(c.cache.Delete(ctx, keys...))
+}
+
+func (c *resilientCache) Invalidate(ctx context.Context, tags ...string) error {
+	return c.check(c.cache.Invalidate(ctx, tags...))
+}
+
+// DeleteStrict returns the error of the cache instead of swallowing it.
+func (c *resilientCache) DeleteStrict(ctx context.Context, keys ...string) error {
+	err := c.cache.Delete(ctx, keys...)
+	c.check(err)
+	return err
+}
+
+// InvalidateStrict returns the error of the cache instead of swallowing it.
+func (c *resilientCache) InvalidateStrict(ctx context.Context, tags ...string) error {
+	err := c.cache.Invalidate(ctx, tags...)
+	c.check(err)
+	return err
+}
+
+// TagVersions fails rather than return versions it could not read, so that
+// the value is not cached.
+func (c *resilientCache) TagVersions(ctx context.Context, tags ...string) ([]int64, error) {
+	versioner, ok := c.cache.(TagVersioner)
+	if !ok {
+		return make([]int64, len(tags)), nil
+	}
+	versions, err := versioner.TagVersions(ctx, tags...)
+	c.check(err)
+	return versions, err
+}
+
+func (c *resilientCache) SetIfCurrent(ctx context.Context, key string, value []byte, ttl time.Duration, versions []int64, tags ...string) error {
+	versioner, ok := c.cache.(TagVersioner)
+	if !ok {
+		return c.Set(ctx, key, value, ttl, tags...)
+	}
+	return c.check(versioner.SetIfCurrent(ctx, key, value, ttl, versions, tags...))
+}
+
+func (c *resilientCache) TryLock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	locker, ok := c.cache.(Locker)
+	if !ok {
+		return func() {}, true, nil
+	}
+	unlock, locked, err := locker.TryLock(ctx, key, ttl)
+	if c.check(err); err != nil {
+		// Load without the lock rather than wait for a holder that may not
+		// exist.
+		return func() {}, true, nil
+	}
+	return unlock, locked, nil
+}
+
+func (c *resilientCache) WithBudget(name string, maxBytes int64) Cache {
+	if budgeter, ok := c.cache.(Budgeter); ok {
+		return newResilientCache(budgeter.WithBudget(name, maxBytes))
+	}
+	return c
+}
+
+func (c *resilientCache) Close() error {
+	return c.cache.Close()
+}
+
+func (c *resilientCache) Sweep(ctx context.Context, patterns ...string) (int64, error) {
+	if sweeper, ok := c.cache.(Sweeper); ok {
+		return sweeper.Sweep(ctx, patterns...)
+	}
+	return 0, nil
+}
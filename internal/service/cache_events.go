@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const cacheEventsChannel = "cache:invalidate"
+
+// cacheEvent is published for every invalidation and deletion, so that the
+// other instances drop the entries from their local caches.
+type cacheEvent struct {
+	Origin string   `json:"origin"`
+	Tags   []string `json:"tags,omitempty"`
+	Keys   []string `json:"keys,omitempty"`
+}
+
+// CacheBus keeps the local caches of instances sharing Redis in line with
+// each other. Events missed while the subscription was interrupted can not
+// be replayed, so the local caches are flushed instead.
+type CacheBus struct {
+	client *redis.Client
+	origin string
+	mu     sync.Mutex
+	locals []*MemoryCache
+}
+
+func NewCacheBus(client *redis.Client) *CacheBus {
+	return &CacheBus{client: client, origin: uuid.New().String()}
+}
+
+func (b *CacheBus) attach(local *MemoryCache) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.locals = append(b.locals, local)
+}
+
+func (b *CacheBus) publish(ctx context.Context, tags, keys []string) {
+	data, err := json.Marshal(cacheEvent{Origin: b.origin, Tags: tags, Keys: keys})
+	if err == nil {
+		err = b.client.Publish(ctx, cacheEventsChannel, data).Err()
+	}
+	if err != nil {
+		logrus.Errorf("Failed to publish cache invalidation: %s", err.Error())
+	}
+}
+
+func (b *CacheBus) apply(ctx context.Context, event cacheEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, local := range b.locals {
+		local.Invalidate(ctx, event.Tags...)
+		local.Delete(ctx, event.Keys...)
+	}
+}
+
+func (b *CacheBus) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, local := range b.locals {
+		local.Flush()
+	}
+}
+
+// Run applies the events of other instances until ctx is done. The client
+// reconnects and subscribes again on its own after an error, and the local
+// caches are flushed both when the subscription breaks and when it is back.
+func (b *CacheBus) Run(ctx context.Context) {
+	pubsub := b.client.Subscribe(ctx, cacheEventsChannel)
+	defer pubsub.Close()
+	subscribed := false
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if subscribed {
+				logrus.Errorf("Cache invalidation subscription interrupted: %s", err.Error())
+				subscribed = false
+			}
+			b.flush()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" {
+				if !subscribed {
+					logrus.Info("Subscribed to cache invalidation")
+				}
+				subscribed = true
+				b.flush()
+			}
+		case *redis.Message:
+			var event cacheEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				logrus.Errorf("Failed to parse cache invalidation: %s", err.Error())
+				continue
+			}
+			if event.Origin != b.origin {
+				b.apply(ctx, event)
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+type CachePolicy struct {
+	ListingTTL  time.Duration
+	DocumentTTL time.Duration
+	// StaleTTL is how long an expired entry is still served while a single
+	// request loads it again in the background.
+	StaleTTL time.Duration
+	// Jitter is the fraction by which TTLs are varied at random, so that
+	// entries cached together do not expire together.
+	Jitter float64
+	// Lock coalesces loads of instances sharing the cache with a lock in it,
+	// when the cache supports locking.
+	Lock bool
+	// LockWait is how long an instance waits for another one holding the
+	// lock before loading the entry itself.
+	LockWait time.Duration
+	// LoadTimeout bounds a load shared by concurrent misses, which does not
+	// end with the request that started it.
+	LoadTimeout time.Duration
+	// ContentMaxSize is the size up to which document bodies are cached,
+	// zero disables caching them. ContentMaxBytes is their budget.
+	ContentMaxSize  int64
+	ContentMaxBytes int64
+}
+
+func (p CachePolicy) withDefaults() CachePolicy {
+	if p.ListingTTL <= 0 {
+		p.ListingTTL = 5 * time.Minute
+	}
+	if p.DocumentTTL <= 0 {
+		p.DocumentTTL = 10 * time.Minute
+	}
+	if p.StaleTTL < 0 {
+		p.StaleTTL = 0
+	}
+	if p.Jitter < 0 || p.Jitter >= 1 {
+		p.Jitter = 0.1
+	}
+	if p.LockWait <= 0 {
+		p.LockWait = 2 * time.Second
+	}
+	if p.LoadTimeout <= 0 {
+		p.LoadTimeout = 30 * time.Second
+	}
+	if p.ContentMaxBytes <= 0 {
+		p.ContentMaxBytes = 64 << 20
+	}
+	return p
+}
+
+// jitter returns ttl varied by up to the Jitter fraction in both directions.
+func (p CachePolicy) jitter(ttl time.Duration) time.Duration {
+	spread := time.Duration(float64(ttl) * p.Jitter)
+	if spread <= 0 {
+		return ttl
+	}
+	return ttl - spread + rand.N(2*spread)
+}
+
+// Locker is implemented by caches shared between instances.
+type Locker interface {
+	// TryLock takes the lock of the key unless someone else holds it. The
+	// lock is released by unlock or after ttl.
+	TryLock(ctx context.Context, key string, ttl time.Duration) (unlock func(), ok bool, err error)
+}
+
+// cacheLoader reads entries through the cache. Concurrent misses of a key in
+// the process are coalesced into a single load, and an expired entry is
+// served for another StaleTTL while it is loaded again in the background.
+type cacheLoader struct {
+	cache  Cache
+	policy CachePolicy
+	mu     sync.Mutex
+	calls  map[string]*loadCall
+}
+
+type loadCall struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+func newCacheLoader(cache Cache, policy CachePolicy) *cacheLoader {
+	return &cacheLoader{
+		cache:  cache,
+		policy: policy.withDefaults(),
+		calls:  make(map[string]*loadCall),
+	}
+}
+
+// Entries start with a marker byte and the time they are fresh until, so
+// values written without it are treated as misses.
+const entryMarker = 0xfe
+
+func encodeEntry(value []byte, fresh time.Time) []byte {
+	entry := make([]byte, 9, 9+len(value))
+	entry[0] = entryMarker
+	binary.BigEndian.PutUint64(entry[1:], uint64(fresh.UnixNano()))
+	return append(entry, value...)
+}
+
+func decodeEntry(entry []byte) (value []byte, fresh time.Time, ok bool) {
+	if len(entry) < 9 || entry[0] != entryMarker {
+		return nil, time.Time{}, false
+	}
+	fresh = time.Unix(0, int64(binary.BigEndian.Uint64(entry[1:9])))
+	return entry[9:], fresh, true
+}
+
+// load returns the cached value of the key or the one returned by fetch,
+// which is then cached for ttl with the tags.
+func (l *cacheLoader) load(ctx context.Context, key string, ttl time.Duration, tags []string, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if entry, err := l.cache.Get(ctx, key); err == nil {
+		if value, fresh, ok := decodeEntry(entry); ok {
+			if time.Now().After(fresh) && !l.loading(key) {
+				go l.do(context.WithoutCancel(ctx), key, ttl, tags, fetch)
+			}
+			return value, nil
+		}
+	}
+	return l.do(ctx, key, ttl, tags, fetch)
+}
+
+func (l *cacheLoader) loading(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.calls[key]
+	return ok
+}
+
+// do runs a single load of the key at a time, callers arriving meanwhile
+// wait for its result. The load is detached from the caller that started
+// it, so that its cancellation does not fail the others; every caller only
+// stops waiting when its own ctx is done.
+func (l *cacheLoader) do(ctx context.Context, key string, ttl time.Duration, tags []string, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	l.mu.Lock()
+	call, ok := l.calls[key]
+	if !ok {
+		call = &loadCall{done: make(chan struct{})}
+		l.calls[key] = call
+		go l.run(context.WithoutCancel(ctx), call, key, ttl, tags, fetch)
+	}
+	l.mu.Unlock()
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *cacheLoader) run(ctx context.Context, call *loadCall, key string, ttl time.Duration, tags []string, fetch func(ctx context.Context) ([]byte, error)) {
+	ctx, cancel := context.WithTimeout(ctx, l.policy.LoadTimeout)
+	defer cancel()
+	call.value, call.err = l.fetch(ctx, key, ttl, tags, fetch)
+	l.mu.Lock()
+	delete(l.calls, key)
+	l.mu.Unlock()
+	close(call.done)
+}
+
+// fetch loads the value and caches it. With Lock set, an instance finding
+// the key locked by another one waits for it to cache the value instead.
+// The versions of the tags are read before the value, so that a value read
+// before a write committed is not cached after the write invalidated it.
+func (l *cacheLoader) fetch(ctx context.Context, key string, ttl time.Duration, tags []string, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if locker, ok := l.cache.(Locker); ok && l.policy.Lock {
+		unlock, locked, err := locker.TryLock(ctx, key, l.policy.LockWait)
+		if err == nil && !locked {
+			if value, ok := l.wait(ctx, key); ok {
+				return value, nil
+			}
+		}
+		if locked {
+			defer unlock()
+		}
+	}
+	versioner, versioned := l.cache.(TagVersioner)
+	var versions []int64
+	if versioned {
+		var err error
+		if versions, err = versioner.TagVersions(ctx, tags...); err != nil {
+			// The value can not be cached safely without them.
+			return fetch(ctx)
+		}
+	}
+	value, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ttl = l.policy.jitter(ttl)
+	entry := encodeEntry(value, time.Now().Add(ttl))
+	if versioned {
+		versioner.SetIfCurrent(ctx, key, entry, ttl+l.policy.StaleTTL, versions, tags...)
+	} else {
+		l.cache.Set(ctx, key, entry, ttl+l.policy.StaleTTL, tags...)
+	}
+	return value, nil
+}
+
+// wait polls the cache for a fresh value of the key for up to LockWait.
+func (l *cacheLoader) wait(ctx context.Context, key string) ([]byte, bool) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(l.policy.LockWait)
+	for {
+		select {
+		case <-ticker.C:
+			if entry, err := l.cache.Get(ctx, key); err == nil {
+				if value, fresh, ok := decodeEntry(entry); ok && time.Now().Before(fresh) {
+					return value, true
+				}
+			}
+		case <-deadline:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type MemoryCacheConfig struct {
+	// MaxEntries and MaxBytes bound the cache, the least recently used
+	// entries are evicted first.
+	MaxEntries int
+	MaxBytes   int64
+	// MaxTTL caps the TTL of every entry when positive.
+	MaxTTL time.Duration
+}
+
+// MemoryCache is a cache local to the process, for deployments without
+// Redis and as the first tier of TieredCache.
+type MemoryCache struct {
+	config  MemoryCacheConfig
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the entries from the most to the least recently used.
+	order *list.List
+	tags  map[string]map[string]struct{}
+	size  int64
+	// versions holds the sequence number of the last invalidation of each
+	// tag, flushed the one of the last flush, which invalidates every tag.
+	// Once versions holds MaxEntries tags, they are folded into flushed,
+	// which only makes loads running at that time skip caching.
+	versions map[string]int64
+	flushed  int64
+	seq      int64
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+	tags    []string
+}
+
+func NewMemoryCache(config MemoryCacheConfig) *MemoryCache {
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = 10000
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 64 << 20
+	}
+	return &MemoryCache{
+		config:   config,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		tags:     make(map[string]map[string]struct{}),
+		versions: make(map[string]int64),
+	}
+}
+
+func (c *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	entry := el.Value.(*memoryEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(el)
+		return nil, ErrCacheMiss
+	}
+	c.order.MoveToFront(el)
+	return entry.value, nil
+}
+
+// Set stores the value, which must not be modified afterwards. Values larger
+// than the whole cache are not stored.
+func (c *MemoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, value, ttl, tags)
+	return nil
+}
+
+func (c *MemoryCache) TagVersions(ctx context.Context, tags ...string) ([]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	versions := make([]int64, 0, len(tags))
+	for _, tag := range tags {
+		versions = append(versions, c.version(tag))
+	}
+	return versions, nil
+}
+
+func (c *MemoryCache) SetIfCurrent(ctx context.Context, key string, value []byte, ttl time.Duration, versions []int64, tags ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, tag := range tags {
+		if i >= len(versions) || c.version(tag) != versions[i] {
+			return nil
+		}
+	}
+	c.set(key, value, ttl, tags)
+	return nil
+}
+
+func (c *MemoryCache) version(tag string) int64 {
+	return max(c.versions[tag], c.flushed)
+}
+
+func (c *MemoryCache) set(key string, value []byte, ttl time.Duration, tags []string) {
+	if c.config.MaxTTL > 0 && (ttl <= 0 || ttl > c.config.MaxTTL) {
+		ttl = c.config.MaxTTL
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	if int64(len(value)) > c.config.MaxBytes {
+		return
+	}
+	entry := &memoryEntry{key: key, value: value, tags: tags}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.size += int64(len(value))
+	for _, tag := range tags {
+		keys, ok := c.tags[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.tags[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	for len(c.entries) > c.config.MaxEntries || c.size > c.config.MaxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *MemoryCache) Delete(ctx context.Context, keys ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+	}
+	return nil
+}
+
+func (c *MemoryCache) Invalidate(ctx context.Context, tags ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	if len(c.versions)+len(tags) > c.config.MaxEntries {
+		c.flushed = c.seq
+		c.versions = make(map[string]int64)
+	}
+	for _, tag := range tags {
+		c.versions[tag] = c.seq
+		for key := range c.tags[tag] {
+			if el, ok := c.entries[key]; ok {
+				c.remove(el)
+			}
+		}
+	}
+	return nil
+}
+
+// WithBudget returns a separate cache of the same kind holding up to
+// maxBytes.
+func (c *MemoryCache) WithBudget(name string, maxBytes int64) Cache {
+	config := c.config
+	config.MaxBytes = maxBytes
+	return NewMemoryCache(config)
+}
+
+// Flush drops every entry and counts as an invalidation of every tag.
+func (c *MemoryCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.tags = make(map[string]map[string]struct{})
+	c.size = 0
+	c.seq++
+	c.flushed = c.seq
+	c.versions = make(map[string]int64)
+}
+
+func (c *MemoryCache) Close() error {
+	return nil
+}
+
+func (c *MemoryCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*memoryEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.value))
+	for _, tag := range entry.tags {
+		delete(c.tags[tag], entry.key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisCache keeps the keys of every tag in a Redis set. Entries and their
+// tags are written and invalidated by Lua scripts. An invalidation also
+// advances a version key of each tag, which SetIfCurrent checks, because an
+// entry loaded before the invalidation may only be written after it.
+type RedisCache struct {
+	client *redis.Client
+	budget *redisBudget
+}
+
+// redisBudget accounts for the entries of a cache with a byte budget in a
+// sorted set of keys by write time, a hash of their sizes and a total.
+type redisBudget struct {
+	name     string
+	maxBytes int64
+}
+
+func (b *redisBudget) keys() []string {
+	prefix := "budget:" + b.name
+	return []string{prefix + ":keys", prefix + ":sizes", prefix + ":bytes"}
+}
+
+func NewRedisCache(client *redis.Client) *RedisCache {
+	return &RedisCache{client: client}
+}
+
+// entryKey namespaces the keys of entries, so that the patterns of
+// LegacyCacheKeys can not match them.
+func entryKey(key string) string {
+	return "cache:" + key
+}
+
+func tagKey(tag string) string {
+	return "tag:" + tag
+}
+
+// versionKey counts the invalidations of a tag. It expires after
+// tagVersionTTL, which only makes loads running at that time skip caching.
+func versionKey(tag string) string {
+	return "version:" + tag
+}
+
+const tagVersionTTL = 24 * time.Hour
+
+var errVersionsMismatch = errors.New("versions do not match the tags")
+
+// sweepKey marks patterns as swept.
+func sweepKey(patterns []string) string {
+	return "swept:" + strings.Join(patterns, ",")
+}
+
+// setScript stores KEYS[1] and adds it to the ARGV[3] tag sets following
+// it. The versions from ARGV[4] on are compared with the version keys after
+// the tag sets first, and nothing is stored if one of them changed. A tag set
+// lives as long as its longest living entry.
+var setScript = redis.NewScript(`
+local tags = tonumber(ARGV[3])
+for i = 4, #ARGV do
+	if tonumber(redis.call('GET', KEYS[tags + i - 2]) or '0') ~= tonumber(ARGV[i]) then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+for i = 2, 1 + tags do
+	redis.call('SADD', KEYS[i], KEYS[1])
+	if redis.call('PTTL', KEYS[i]) < tonumber(ARGV[2]) then
+		redis.call('PEXPIRE', KEYS[i], ARGV[2])
+	end
+end
+return 1
+`)
+
+// invalidateScript unlinks the members of the tag sets in the first half of
+// KEYS and the sets themselves, and increments the version keys in the
+// second half. Members are unlinked in batches to stay below the limit of
+// arguments to unpack.
+var invalidateScript = redis.NewScript(`
+local removed = 0
+local tags = #KEYS / 2
+for i = 1, tags do
+	local keys = redis.call('SMEMBERS', KEYS[i])
+	for j = 1, #keys, 500 do
+		removed = removed + redis.call('UNLINK', unpack(keys, j, math.min(j + 499, #keys)))
+	end
+	redis.call('UNLINK', KEYS[i])
+	redis.call('INCR', KEYS[tags + i])
+	redis.call('PEXPIRE', KEYS[tags + i], ARGV[1])
+end
+return removed
+`)
+
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// budgetSetScript stores KEYS[1] like setScript and accounts for it in the
+// budget in KEYS[2..4], evicting the oldest entries while the budget is
+// exceeded. Entries that expired or were invalidated are accounted for until
+// they are evicted, they are the oldest ones anyway. The number of tags is
+// in ARGV[5] and the versions follow it.
+var budgetSetScript = redis.NewScript(`
+local tags = tonumber(ARGV[5])
+for i = 6, #ARGV do
+	if tonumber(redis.call('GET', KEYS[tags + i - 1]) or '0') ~= tonumber(ARGV[i]) then
+		return 0
+	end
+end
+local size = string.len(ARGV[1])
+local previous = redis.call('HGET', KEYS[3], KEYS[1])
+if previous then
+	redis.call('DECRBY', KEYS[4], previous)
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[4], KEYS[1])
+redis.call('HSET', KEYS[3], KEYS[1], size)
+local total = redis.call('INCRBY', KEYS[4], size)
+while total > tonumber(ARGV[3]) do
+	local oldest = redis.call('ZPOPMIN', KEYS[2])
+	if #oldest == 0 then
+		break
+	end
+	local evicted = redis.call('HGET', KEYS[3], oldest[1]) or 0
+	redis.call('HDEL', KEYS[3], oldest[1])
+	redis.call('UNLINK', oldest[1])
+	total = redis.call('DECRBY', KEYS[4], evicted)
+end
+for i = 5, 4 + tags do
+	redis.call('SADD', KEYS[i], KEYS[1])
+	if redis.call('PTTL', KEYS[i]) < tonumber(ARGV[2]) then
+		redis.call('PEXPIRE', KEYS[i], ARGV[2])
+	end
+end
+return 1
+`)
+
+func (c *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := c.client.Get(ctx, entryKey(key)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrCacheMiss
+	}
+	return value, err
+}
+
+func (c *RedisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags ...string) error {
+	return c.set(ctx, key, value, ttl, nil, tags)
+}
+
+func (c *RedisCache) TagVersions(ctx context.Context, tags ...string) ([]int64, error) {
+	versions := make([]int64, len(tags))
+	if len(tags) == 0 {
+		return versions, nil
+	}
+	keys := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		keys = append(keys, versionKey(tag))
+	}
+	values, err := c.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		if value, ok := value.(string); ok {
+			if versions[i], err = strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return versions, nil
+}
+
+func (c *RedisCache) SetIfCurrent(ctx context.Context, key string, value []byte, ttl time.Duration, versions []int64, tags ...string) error {
+	if len(versions) != len(tags) {
+		return errVersionsMismatch
+	}
+	return c.set(ctx, key, value, ttl, versions, tags)
+}
+
+// set stores the entry, versions are checked unless they are nil.
+func (c *RedisCache) set(ctx context.Context, key string, value []byte, ttl time.Duration, versions []int64, tags []string) error {
+	key = entryKey(key)
+	script, keys := setScript, []string{key}
+	args := []any{value, ttl.Milliseconds()}
+	if c.budget != nil {
+		if int64(len(value)) > c.budget.maxBytes {
+			return nil
+		}
+		script, keys = budgetSetScript, append(keys, c.budget.keys()...)
+		args = append(args, c.budget.maxBytes, time.Now().UnixMilli())
+	} else if len(tags) == 0 {
+		return c.client.Set(ctx, key, value, ttl).Err()
+	}
+	args = append(args, len(tags))
+	for _, tag := range tags {
+		keys = append(keys, tagKey(tag))
+	}
+	for i, version := range versions {
+		keys = append(keys, versionKey(tags[i]))
+		args = append(args, version)
+	}
+	return script.Run(ctx, c.client, keys, args...).Err()
+}
+
+func (c *RedisCache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	entries := make([]string, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, entryKey(key))
+	}
+	return c.client.Unlink(ctx, entries...).Err()
+}
+
+func (c *RedisCache) Invalidate(ctx context.Context, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, 2*len(tags))
+	for _, tag := range tags {
+		keys = append(keys, tagKey(tag))
+	}
+	for _, tag := range tags {
+		keys = append(keys, versionKey(tag))
+	}
+	return invalidateScript.Run(ctx, c.client, keys, tagVersionTTL.Milliseconds()).Err()
+}
+
+// TryLock sets a lock key holding a random token, so that a lock that has
+// expired and been taken by someone else is not released by unlock.
+func (c *RedisCache) TryLock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	lockKey, token := "lock:"+key, uuid.New().String()
+	ok, err := c.client.SetNX(ctx, lockKey, token, ttl).Result()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	unlock := func() {
+		unlockScript.Run(context.Background(), c.client, []string{lockKey}, token)
+	}
+	return unlock, true, nil
+}
+
+// WithBudget returns a cache sharing the connection whose entries are kept
+// within maxBytes. Closing it closes the connection.
+func (c *RedisCache) WithBudget(name string, maxBytes int64) Cache {
+	return &RedisCache{client: c.client, budget: &redisBudget{name: name, maxBytes: maxBytes}}
+}
+
+func (c *RedisCache) Close() error {
+	return c.client.Close()
+}
+
+// Sweep unlinks the keys matching the patterns. It walks the keyspace with
+// SCAN, which does not block Redis like KEYS does, and is meant for entries
+// written before they were tagged. Once a sweep of the patterns completes, a
+// marker key makes later calls return right away.
+func (c *RedisCache) Sweep(ctx context.Context, patterns ...string) (int64, error) {
+	marker := sweepKey(patterns)
+	if swept, err := c.client.Exists(ctx, marker).Result(); err != nil || swept > 0 {
+		return 0, err
+	}
+	var removed int64
+	for _, pattern := range patterns {
+		iter := c.client.Scan(ctx, 0, pattern, 1000).Iterator()
+		batch := make([]string, 0, 1000)
+		for iter.Next(ctx) {
+			batch = append(batch, iter.Val())
+			if len(batch) == cap(batch) {
+				n, err := c.client.Unlink(ctx, batch...).Result()
+				if err != nil {
+					return removed, err
+				}
+				removed += n
+				batch = batch[:0]
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return removed, err
+		}
+		if len(batch) > 0 {
+			n, err := c.client.Unlink(ctx, batch...).Result()
+			if err != nil {
+				return removed, err
+			}
+			removed += n
+		}
+	}
+	return removed, c.client.Set(ctx, marker, time.Now().Unix(), 0).Err()
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// TieredCache serves entries from a local cache in front of a shared one.
+// The local tier only holds entries written by this instance, whose tags are
+// known, so local invalidation is exact. Invalidations are published on the
+// bus to reach the local tiers of other instances, entries whose
+// invalidation got lost expire after LocalTTL.
+type TieredCache struct {
+	local  *MemoryCache
+	remote Cache
+	ttl    time.Duration
+	bus    *CacheBus
+}
+
+// NewTieredCache creates the cache, bus may be nil for a single instance.
+func NewTieredCache(local *MemoryCache, remote Cache, localTTL time.Duration, bus *CacheBus) *TieredCache {
+	if localTTL <= 0 {
+		localTTL = 5 * time.Second
+	}
+	if bus != nil {
+		bus.attach(local)
+	}
+	return &TieredCache{local: local, remote: remote, ttl: localTTL, bus: bus}
+}
+
+func (c *TieredCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if value, err := c.local.Get(ctx, key); err == nil {
+		return value, nil
+	}
+	return c.remote.Get(ctx, key)
+}
+
+func (c *TieredCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration, tags ...string) error {
+	c.local.Set(ctx, key, value, c.localTTL(ttl), tags...)
+	return c.remote.Set(ctx, key, value, ttl, tags...)
+}
+
+// TagVersions returns the versions of the local tier followed by those of
+// the remote one.
+func (c *TieredCache) TagVersions(ctx context.Context, tags ...string) ([]int64, error) {
+	versions, _ := c.local.TagVersions(ctx, tags...)
+	if versioner, ok := c.remote.(TagVersioner); ok {
+		remote, err := versioner.TagVersions(ctx, tags...)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, remote...)
+	}
+	return versions, nil
+}
+
+func (c *TieredCache) SetIfCurrent(ctx context.Context, key string, value []byte, ttl time.Duration, versions []int64, tags ...string) error {
+	if len(versions) < len(tags) {
+		return errVersionsMismatch
+	}
+	c.local.SetIfCurrent(ctx, key, value, c.localTTL(ttl), versions[:len(tags)], tags...)
+	if versioner, ok := c.remote.(TagVersioner); ok {
+		return versioner.SetIfCurrent(ctx, key, value, ttl, versions[len(tags):], tags...)
+	}
+	return c.remote.Set(ctx, key, value, ttl, tags...)
+}
+
+func (c *TieredCache) localTTL(ttl time.Duration) time.Duration {
+	if ttl > 0 && ttl < c.ttl {
+		return ttl
+	}
+	return c.ttl
+}
+
+func (c *TieredCache) Delete(ctx context.Context, keys ...string) error {
+	return c.delete(ctx, false, keys)
+}
+
+func (c *TieredCache) DeleteStrict(ctx context.Context, keys ...string) error {
+	return c.delete(ctx, true, keys)
+}
+
+func (c *TieredCache) delete(ctx context.Context, strict bool, keys []string) error {
+	c.local.Delete(ctx, keys...)
+	var err error
+	if strict {
+		err = deleteStrict(ctx, c.remote, keys...)
+	} else {
+		err = c.remote.Delete(ctx, keys...)
+	}
+	if c.bus != nil && len(keys) > 0 {
+		c.bus.publish(ctx, nil, keys)
+	}
+	return err
+}
+
+func (c *TieredCache) Invalidate(ctx context.Context, tags ...string) error {
+	return c.invalidate(ctx, false, tags)
+}
+
+func (c *TieredCache) InvalidateStrict(ctx context.Context, tags ...string) error {
+	return c.invalidate(ctx, true, tags)
+}
+
+func (c *TieredCache) invalidate(ctx context.Context, strict bool, tags []string) error {
+	c.local.Invalidate(ctx, tags...)
+	var err error
+	if strict {
+		err = invalidateStrict(ctx, c.remote, tags...)
+	} else {
+		err = c.remote.Invalidate(ctx, tags...)
+	}
+	if c.bus != nil && len(tags) > 0 {
+		c.bus.publish(ctx, tags, nil)
+	}
+	return err
+}
+
+func (c *TieredCache) Subscribe(ctx context.Context) {
+	if c.bus != nil {
+		c.bus.Run(ctx)
+	}
+}
+
+func (c *TieredCache) TryLock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	if locker, ok := c.remote.(Locker); ok {
+		return locker.TryLock(ctx, key, ttl)
+	}
+	return func() {}, true, nil
+}
+
+func (c *TieredCache) WithBudget(name string, maxBytes int64) Cache {
+	remote := c.remote
+	if budgeter, ok := c.remote.(Budgeter); ok {
+		remote = budgeter.WithBudget(name, maxBytes)
+	}
+	return NewTieredCache(c.local.WithBudget(name, maxBytes).(*MemoryCache), remote, c.ttl, c.bus)
+}
+
+func (c *TieredCache) Close() error {
+	return c.remote.Close()
+}
+
+func (c *TieredCache) Sweep(ctx context.Context, patterns ...string) (int64, error) {
+	if sweeper, ok := c.remote.(Sweeper); ok {
+		return sweeper.Sweep(ctx, patterns...)
+	}
+	return 0, nil
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lavatee/astraltest/internal/model"
+)
+
+// ParseSort parses a comma separated list of fields, a leading "-" sorts the
+// field in descending order: "-created,name".
+func ParseSort(raw string) ([]model.SortField, error) {
+	if strings.TrimSpace(raw) == "" {
+		return model.DefaultDocumentSort, nil
+	}
+	var sort []model.SortField
+	for _, part := range strings.Split(raw, ",") {
+		field := model.SortField{Field: strings.TrimSpace(part)}
+		if strings.HasPrefix(field.Field, "-") {
+			field.Field = field.Field[1:]
+			field.Desc = true
+		}
+		def, ok := model.DocumentFilterFields[field.Field]
+		if !ok {
+			return nil, fmt.Errorf("unknown sort field %q", field.Field)
+		}
+		if def.Nullable {
+			return nil, fmt.Errorf("field %q can not be used for sorting", field.Field)
+		}
+		sort = append(sort, field)
+	}
+	return sort, nil
+}
+
+func sortString(sort []model.SortField) string {
+	fields := make([]string, len(sort))
+	for i, field := range sort {
+		fields[i] = field.Field
+		if field.Desc {
+			fields[i] = "-" + field.Field
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+type cursorPayload struct {
+	Sort   string        `json:"s"`
+	Values []interface{} `json:"v"`
+	ID     string        `json:"id"`
+}
+
+// EncodeCursor builds an opaque cursor pointing right after doc.
+func EncodeCursor(doc *model.Document, sort []model.SortField) string {
+	payload := cursorPayload{Sort: sortString(sort), ID: doc.ID}
+	for _, field := range sort {
+		payload.Values = append(payload.Values, doc.FieldValue(field.Field))
+	}
+	data, _ := json.Marshal(payload)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseCursor decodes a cursor and checks that it was issued for the same
+// sort order.
+func ParseCursor(raw string, sort []model.SortField) (*model.Cursor, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	invalid := errors.New("invalid cursor")
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, invalid
+	}
+	var payload cursorPayload
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, invalid
+	}
+	if payload.Sort != sortString(sort) || len(payload.Values) != len(sort) || payload.ID == "" {
+		return nil, errors.New("cursor does not match the requested sort")
+	}
+	cursor := &model.Cursor{ID: payload.ID}
+	for i, field := range sort {
+		value, err := cursorValue(model.DocumentFilterFields[field.Field].Type, payload.Values[i])
+		if err != nil {
+			return nil, invalid
+		}
+		cursor.Values = append(cursor.Values, value)
+	}
+	return cursor, nil
+}
+
+func cursorValue(fieldType model.FieldType, value interface{}) (interface{}, error) {
+	switch fieldType {
+	case model.FieldInt:
+		if v, ok := value.(json.Number); ok {
+			return v.Int64()
+		}
+	case model.FieldBool:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+	case model.FieldTime:
+		if v, ok := value.(string); ok {
+			return time.Parse(time.RFC3339Nano, v)
+		}
+	default:
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected cursor value %v", value)
+}
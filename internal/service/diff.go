@@ -0,0 +1,92 @@
+package service
+
+import (
+	"io"
+	"strings"
+
+	"github.com/lavatee/astraltest/internal/apperror"
+	"github.com/lavatee/astraltest/internal/model"
+)
+
+const (
+	// maxDiffSize limits the body of each diffed version.
+	maxDiffSize = 1 << 20
+	// maxDiffCells limits the LCS table of the lines left after the common
+	// prefix and suffix are cut, which takes quadratic memory.
+	maxDiffCells = 4 << 20
+)
+
+var ErrDiffTooLarge = apperror.New(apperror.Validation, "Versions are too large to diff")
+
+// readDiffBody reads a version body of at most maxDiffSize bytes.
+func readDiffBody(body io.Reader) (string, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxDiffSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxDiffSize {
+		return "", ErrDiffTooLarge
+	}
+	return string(data), nil
+}
+
+// diffLines builds a line based diff of two text revisions using the longest
+// common subsequence of their lines. Lines shared at both ends are cut off
+// first, so that small edits of large documents stay cheap.
+func diffLines(from, to string) ([]model.DiffLine, error) {
+	a := strings.Split(from, "\n")
+	b := strings.Split(to, "\n")
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	var lines []model.DiffLine
+	for _, line := range a[:prefix] {
+		lines = append(lines, model.DiffLine{Op: " ", Text: line})
+	}
+	tail := a[len(a)-suffix:]
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		return nil, ErrDiffTooLarge
+	}
+	width := len(b) + 1
+	lcs := make([]int, (len(a)+1)*width)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			} else {
+				lcs[i*width+j] = max(lcs[(i+1)*width+j], lcs[i*width+j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, model.DiffLine{Op: " ", Text: a[i]})
+			i++
+			j++
+		case lcs[(i+1)*width+j] >= lcs[i*width+j+1]:
+			lines = append(lines, model.DiffLine{Op: "-", Text: a[i]})
+			i++
+		default:
+			lines = append(lines, model.DiffLine{Op: "+", Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, model.DiffLine{Op: "-", Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, model.DiffLine{Op: "+", Text: b[j]})
+	}
+	for _, line := range tail {
+		lines = append(lines, model.DiffLine{Op: " ", Text: line})
+	}
+	return lines, nil
+}
@@ -1,134 +1,586 @@
 package service
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io"
-	"mime/multipart"
 	"strconv"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/lavatee/astraltest/internal/apperror"
 	"github.com/lavatee/astraltest/internal/model"
 	"github.com/lavatee/astraltest/internal/repository"
-	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrInvalidMeta   = apperror.New(apperror.Validation, "Invalid document meta")
+	ErrFileNotLoaded = apperror.New(apperror.Validation, "File has not been loaded")
 )
 
 type DocumentService struct {
-	repo  *repository.Repository
-	cache *redis.Client
+	repo   *repository.Repository
+	cache  Cache
+	loader *cacheLoader
+	// content caches small bodies within a budget of their own, it is nil
+	// when the cache does not support budgets or ContentMaxSize is zero.
+	content *cacheLoader
 }
 
-func NewDocumentService(repo *repository.Repository, cache *redis.Client) *DocumentService {
-	return &DocumentService{
-		repo:  repo,
-		cache: cache,
+func NewDocumentService(repo *repository.Repository, cache Cache, policy CachePolicy) *DocumentService {
+	s := &DocumentService{
+		repo:   repo,
+		cache:  cache,
+		loader: newCacheLoader(cache, policy),
 	}
+	if budgeter, ok := cache.(Budgeter); ok && s.loader.policy.ContentMaxSize > 0 {
+		s.content = newCacheLoader(budgeter.WithBudget("content", s.loader.policy.ContentMaxBytes), policy)
+	}
+	return s
 }
 
-func (s *DocumentService) invalidateUserCache(ctx context.Context, token string) error {
-	pattern := "docs:" + token + "*"
-	keys, err := s.cache.Keys(ctx, pattern).Result()
-	if err != nil {
-		return err
+// Cached listings are tagged with the user they were loaded for and with
+// listingsTag, cached documents, their access lists and bodies with the tag
+// of the document. Writes invalidate the tags of every user whose view they
+// affect, or listingsTag for changes to documents everyone can see. The
+// groups of a user, used for access checks, carry a tag of their own.
+const listingsTag = "docs"
+
+func userTag(userID int) string {
+	return "docs:" + strconv.Itoa(userID)
+}
+
+func documentTag(id string) string {
+	return "doc:" + id
+}
+
+func groupsTag(userID int) string {
+	return "groups:" + strconv.Itoa(userID)
+}
+
+// LegacyCacheKeys match cache entries written before they were tagged. They
+// are not found by invalidation and have to be swept once. Current entries
+// live under the "cache:" prefix and never match.
+var LegacyCacheKeys = []string{"docs:*", "doc:*", "gen:docs:*"}
+
+func (s *DocumentService) invalidateUserCache(ctx context.Context, userID int) error {
+	return s.cache.Invalidate(ctx, userTag(userID))
+}
+
+// invalidateAudience drops the listing caches of everyone who can see the
+// document through ownership or grants, group members included.
+func (s *DocumentService) invalidateAudience(ctx context.Context, users []int) error {
+	return s.cache.Invalidate(ctx, audienceTags(users)...)
+}
+
+func audienceTags(users []int) []string {
+	seen := make(map[int]bool, len(users))
+	tags := make([]string, 0, len(users))
+	for _, userID := range users {
+		if !seen[userID] {
+			seen[userID] = true
+			tags = append(tags, userTag(userID))
+		}
+	}
+	return tags
+}
+
+// invalidateListings drops the listing caches of every user, for changes to
+// documents that everyone can see.
+func (s *DocumentService) invalidateListings(ctx context.Context) error {
+	return s.cache.Invalidate(ctx, listingsTag)
+}
+
+// invalidateDocuments drops the documents along with their access lists,
+// failing if the cache could not be reached.
+func (s *DocumentService) invalidateDocuments(ctx context.Context, ids []string) error {
+	tags := make([]string, 0, len(ids))
+	for _, id := range ids {
+		tags = append(tags, documentTag(id))
 	}
-	if len(keys) > 0 {
-		if err := s.cache.Del(ctx, keys...).Err(); err != nil {
+	return s.invalidateDocumentTags(ctx, true, tags...)
+}
+
+// invalidateDocumentTags invalidates the tags in the cache of bodies as well.
+// With strict set, failures are reported even if the caches hide them
+// otherwise.
+func (s *DocumentService) invalidateDocumentTags(ctx context.Context, strict bool, tags ...string) error {
+	if s.content != nil {
+		if err := invalidateTags(ctx, s.content.cache, strict, tags...); err != nil {
 			return err
 		}
 	}
-	return nil
+	return invalidateTags(ctx, s.cache, strict, tags...)
+}
+
+func invalidateTags(ctx context.Context, cache Cache, strict bool, tags ...string) error {
+	if strict {
+		return invalidateStrict(ctx, cache, tags...)
+	}
+	return cache.Invalidate(ctx, tags...)
+}
+
+// invalidateMemberships drops the cached groups of the users along with
+// their listings. A membership that was not invalidated would grant access
+// until it expires, so failures are reported.
+func (s *DocumentService) invalidateMemberships(ctx context.Context, users []int) error {
+	tags := audienceTags(users)
+	for _, userID := range users {
+		tags = append(tags, groupsTag(userID))
+	}
+	return invalidateStrict(ctx, s.cache, tags...)
+}
+
+// invalidate drops the cached document and the listings it appears in,
+// those of every user for public documents.
+func (s *DocumentService) invalidate(ctx context.Context, id string, public bool, audience []int) error {
+	return s.invalidateDocumentTags(ctx, false, documentTags(id, public, audience)...)
+}
+
+// invalidateAccess is invalidate for changes of who may access the document,
+// which fail if the cached access list could not be dropped.
+func (s *DocumentService) invalidateAccess(ctx context.Context, id string, public bool, audience []int) error {
+	return s.invalidateDocumentTags(ctx, true, documentTags(id, public, audience)...)
+}
+
+func documentTags(id string, public bool, audience []int) []string {
+	tags := []string{documentTag(id)}
+	if public {
+		return append(tags, listingsTag)
+	}
+	return append(tags, audienceTags(audience)...)
+}
+
+// audience returns the users who can see the document, falling back to the
+// principal alone when they can not be determined.
+func (s *DocumentService) audience(ctx context.Context, principal *model.Principal, id string) []int {
+	users, err := s.repo.Documents.GetAudience(ctx, id)
+	if err != nil {
+		return []int{principal.UserID}
+	}
+	return append(users, principal.UserID)
 }
 
-func (s *DocumentService) Upload(ctx context.Context, token, meta, jsonData string, file multipart.File, header *multipart.FileHeader, isFileLoaded bool) (*model.Document, error) {
+func (s *DocumentService) Upload(ctx context.Context, principal *model.Principal, meta, jsonData string, file io.Reader, isFileLoaded bool) (*model.Document, error) {
+	if err := authorize(principal, model.PermDocsWrite); err != nil {
+		return nil, err
+	}
 	var metaData model.DocumentMeta
 	if err := json.Unmarshal([]byte(meta), &metaData); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMeta, err)
+	}
+	if err := validateGrants(metaData.Grant, metaData.GrantGroups); err != nil {
 		return nil, err
 	}
 	doc := &model.Document{
-		ID:      uuid.New().String(),
-		Name:    metaData.Name,
-		Mime:    metaData.Mime,
-		File:    metaData.File,
-		Public:  metaData.Public,
-		Created: time.Now(),
-		Grant:   metaData.Grant,
-	}
-	var fileData []byte
-	if metaData.File {
-		var err error
-		if !isFileLoaded {
-			return nil, errors.New("File has not been loaded")
-		}
-		fileData, err = io.ReadAll(file)
-		if err != nil {
-			return nil, err
-		}
+		ID:          uuid.New().String(),
+		Name:        metaData.Name,
+		Mime:        metaData.Mime,
+		File:        metaData.File,
+		Public:      metaData.Public,
+		Created:     time.Now(),
+		Grant:       metaData.Grant,
+		GrantGroups: metaData.GrantGroups,
+	}
+	if metaData.File && !isFileLoaded {
+		return nil, ErrFileNotLoaded
 	}
-	if err := s.repo.Documents.Create(ctx, token, doc, jsonData, fileData); err != nil {
+	if err := s.repo.Documents.Create(ctx, principal.UserID, doc, jsonData, file); err != nil {
 		return nil, err
 	}
-	if err := s.invalidateUserCache(ctx, token); err != nil {
+	if err := s.invalidate(ctx, doc.ID, doc.Public, s.audience(ctx, principal, doc.ID)); err != nil {
 		return nil, err
 	}
 	return doc, nil
 }
 
-func (s *DocumentService) GetAll(ctx context.Context, token, login, key, value string, limit int) ([]*model.Document, error) {
-	cacheKey := "docs:" + token
-	if login != "" {
-		cacheKey += ":" + login
+func (s *DocumentService) Update(ctx context.Context, principal *model.Principal, id, meta, jsonData string, file io.Reader, isFileLoaded bool) (*model.Document, error) {
+	if err := authorize(principal, model.PermDocsWrite); err != nil {
+		return nil, err
 	}
-	if key != "" && value != "" {
-		cacheKey += ":" + key + ":" + value
+	var metaData model.DocumentMeta
+	if err := json.Unmarshal([]byte(meta), &metaData); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMeta, err)
 	}
-	if limit > 0 {
-		cacheKey += ":limit:" + strconv.Itoa(limit)
+	doc := &model.Document{
+		ID:   id,
+		Name: metaData.Name,
+		Mime: metaData.Mime,
+		File: metaData.File,
 	}
-	if cached, err := s.cache.Get(ctx, cacheKey).Result(); err == nil {
-		var docs []*model.Document
-		if err := json.Unmarshal([]byte(cached), &docs); err == nil {
-			return docs, nil
+	if metaData.File && !isFileLoaded {
+		return nil, ErrFileNotLoaded
+	}
+	if err := s.repo.Documents.Update(ctx, s.actingUserID(ctx, principal, id), doc, jsonData, file); err != nil {
+		return nil, err
+	}
+	if err := s.invalidate(ctx, id, doc.Public, s.audience(ctx, principal, id)); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (s *DocumentService) GetAll(ctx context.Context, principal *model.Principal, query model.DocumentQuery) (*model.DocumentPage, error) {
+	if err := authorize(principal, model.PermDocsRead); err != nil {
+		return nil, err
+	}
+	if len(query.Sort) == 0 {
+		query.Sort = model.DefaultDocumentSort
+	}
+	cacheKey := userTag(principal.UserID)
+	if query.Login != "" {
+		cacheKey += ":" + query.Login
+	}
+	if len(query.Filter) > 0 {
+		cacheKey += ":filter:" + query.Filter.String()
+	}
+	cacheKey += ":sort:" + sortString(query.Sort)
+	if query.Cursor != nil {
+		cacheKey += ":cursor:" + query.Cursor.String()
+	}
+	if query.Limit > 0 {
+		cacheKey += ":limit:" + strconv.Itoa(query.Limit)
+	}
+	if query.Total {
+		cacheKey += ":total"
+	}
+	tags := []string{userTag(principal.UserID), listingsTag}
+	data, err := s.loader.load(ctx, cacheKey, s.loader.policy.ListingTTL, tags, func(ctx context.Context) ([]byte, error) {
+		page, err := s.getPage(ctx, principal, query)
+		if err != nil {
+			return nil, err
 		}
+		return json.Marshal(page)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var page model.DocumentPage
+	if err := json.Unmarshal(data, &page); err != nil {
+		return nil, err
 	}
-	docs, err := s.repo.GetAll(ctx, token, login, key, value, limit)
+	return &page, nil
+}
+
+// getPage loads one more document than requested to find out whether there
+// is a next page without a separate query.
+func (s *DocumentService) getPage(ctx context.Context, principal *model.Principal, query model.DocumentQuery) (*model.DocumentPage, error) {
+	limit := query.Limit
+	if limit > 0 {
+		query.Limit++
+	}
+	docs, err := s.repo.Documents.GetAll(ctx, principal.UserID, query)
 	if err != nil {
 		return nil, err
 	}
-	if data, err := json.Marshal(docs); err == nil {
-		s.cache.Set(ctx, cacheKey, data, 5*time.Minute)
+	page := &model.DocumentPage{Docs: docs}
+	if page.Docs == nil {
+		page.Docs = []*model.Document{}
+	}
+	if limit > 0 && len(docs) > limit {
+		page.Docs = docs[:limit]
+		page.NextCursor = EncodeCursor(page.Docs[limit-1], query.Sort)
+	}
+	if query.Total {
+		total, err := s.repo.Documents.Count(ctx, principal.UserID, query)
+		if err != nil {
+			return nil, err
+		}
+		page.Total = &total
 	}
-	return docs, nil
+	return page, nil
 }
 
-func (s *DocumentService) GetByID(ctx context.Context, token, id string) (*model.Document, []byte, error) {
-	cacheKey := "doc:" + id
-	if cached, err := s.cache.Get(ctx, cacheKey).Result(); err == nil {
-		var doc model.Document
-		if err := json.Unmarshal([]byte(cached), &doc); err == nil {
-			fileData, err := s.repo.GetFileData(ctx, token, id)
-			return &doc, fileData, err
+// GetByID serves the document from the cache when possible. The metadata
+// and the body are shared by everyone who can see the document, the access
+// check runs on every call against the cached access list, so that a hit
+// does not touch the database.
+func (s *DocumentService) GetByID(ctx context.Context, principal *model.Principal, id string) (*model.Document, io.ReadCloser, error) {
+	if err := authorize(principal, model.PermDocsRead); err != nil {
+		return nil, nil, err
+	}
+	acl, err := s.getACL(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	allowed, err := s.canRead(ctx, principal, acl)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !allowed {
+		return nil, nil, repository.ErrDocumentNotFound
+	}
+	cacheKey := documentTag(id)
+	data, err := s.loader.load(ctx, cacheKey, s.loader.policy.DocumentTTL, []string{cacheKey}, func(ctx context.Context) ([]byte, error) {
+		doc, err := s.repo.Documents.GetMeta(ctx, id)
+		if err != nil {
+			return nil, err
 		}
+		return json.Marshal(doc)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc model.Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
 	}
-	doc, fileData, err := s.repo.Documents.GetByID(ctx, token, id)
+	userID := principal.UserID
+	if principal.Can(model.PermDocsManage) {
+		userID = acl.OwnerID
+	}
+	body, err := s.getContent(ctx, userID, &doc)
 	if err != nil {
 		return nil, nil, err
 	}
+	return &doc, body, nil
+}
 
-	if data, err := json.Marshal(doc); err == nil {
-		s.cache.Set(ctx, cacheKey, data, 10*time.Minute)
+func (s *DocumentService) getACL(ctx context.Context, id string) (*model.DocumentACL, error) {
+	data, err := s.loader.load(ctx, "acl:"+id, s.loader.policy.DocumentTTL, []string{documentTag(id)}, func(ctx context.Context) ([]byte, error) {
+		acl, err := s.repo.Documents.GetACL(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(acl)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return doc, fileData, nil
+	var acl model.DocumentACL
+	if err := json.Unmarshal(data, &acl); err != nil {
+		return nil, err
+	}
+	return &acl, nil
 }
 
-func (s *DocumentService) Delete(ctx context.Context, token, id string) error {
-	if err := s.repo.Delete(ctx, token, id); err != nil {
+// canRead checks the principal against the access list of a document,
+// loading its groups only for documents shared with groups.
+func (s *DocumentService) canRead(ctx context.Context, principal *model.Principal, acl *model.DocumentACL) (bool, error) {
+	if principal.Can(model.PermDocsManage) || acl.Allows(principal.UserID, nil) {
+		return true, nil
+	}
+	if len(acl.Groups) == 0 {
+		return false, nil
+	}
+	tag := groupsTag(principal.UserID)
+	data, err := s.loader.load(ctx, tag, s.loader.policy.ListingTTL, []string{tag}, func(ctx context.Context) ([]byte, error) {
+		groups, err := s.repo.Groups.GetUserGroupIDs(ctx, principal.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(groups)
+	})
+	if err != nil {
+		return false, err
+	}
+	var groups []int
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return false, err
+	}
+	return acl.Allows(principal.UserID, groups), nil
+}
+
+// getContent returns the body of the document. Bodies up to ContentMaxSize
+// are cached gzipped, under the version they belong to.
+func (s *DocumentService) getContent(ctx context.Context, userID int, doc *model.Document) (io.ReadCloser, error) {
+	if s.content == nil || doc.Size <= 0 || doc.Size > s.content.policy.ContentMaxSize {
+		return s.repo.Documents.GetFileData(ctx, userID, doc.ID)
+	}
+	key := documentTag(doc.ID) + ":content:" + strconv.Itoa(doc.Version)
+	data, err := s.content.load(ctx, key, s.content.policy.DocumentTTL, []string{documentTag(doc.ID)}, func(ctx context.Context) ([]byte, error) {
+		body, err := s.repo.Documents.GetFileData(ctx, userID, doc.ID)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return compress(body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data)
+}
+
+func (s *DocumentService) Delete(ctx context.Context, principal *model.Principal, id string) error {
+	if err := authorize(principal, model.PermDocsWrite); err != nil {
+		return err
+	}
+	userID := s.actingUserID(ctx, principal, id)
+	audience := s.audience(ctx, principal, id)
+	public, err := s.repo.Documents.IsPublic(ctx, id)
+	if err != nil {
 		return err
 	}
-	s.cache.Del(ctx, "doc:"+id)
-	if err := s.invalidateUserCache(ctx, token); err != nil {
+	if err := s.repo.Documents.Delete(ctx, userID, id); err != nil {
 		return err
 	}
+	return s.invalidateAccess(ctx, id, public, audience)
+}
+
+// Patch changes the metadata of the document. Public documents are listed
+// for everyone, so changing one of them drops every listing cache.
+func (s *DocumentService) Patch(ctx context.Context, principal *model.Principal, id string, patch model.DocumentPatch) (*model.Document, error) {
+	if err := authorize(principal, model.PermDocsWrite); err != nil {
+		return nil, err
+	}
+	doc, err := s.repo.Documents.Patch(ctx, s.actingUserID(ctx, principal, id), id, patch)
+	if err != nil {
+		return nil, err
+	}
+	if patch.Public != nil {
+		return doc, s.invalidateAccess(ctx, id, true, s.audience(ctx, principal, id))
+	}
+	return doc, s.invalidate(ctx, id, doc.Public, s.audience(ctx, principal, id))
+}
+
+// AddGrant shares the document with a user or a group.
+func (s *DocumentService) AddGrant(ctx context.Context, principal *model.Principal, id string, req model.GrantRequest) (*model.Document, error) {
+	if err := authorize(principal, model.PermDocsWrite); err != nil {
+		return nil, err
+	}
+	if err := validateGrantRequest(&req); err != nil {
+		return nil, err
+	}
+	doc, err := s.repo.Documents.AddGrant(ctx, s.actingUserID(ctx, principal, id), id, req)
+	if err != nil {
+		return nil, err
+	}
+	return doc, s.invalidateAccess(ctx, id, doc.Public, s.audience(ctx, principal, id))
+}
+
+// RevokeGrant removes the share of a user or a group. The audience is taken
+// before the grant is gone, so the users losing access are included.
+func (s *DocumentService) RevokeGrant(ctx context.Context, principal *model.Principal, id string, req model.GrantRequest) (*model.Document, error) {
+	if err := authorize(principal, model.PermDocsWrite); err != nil {
+		return nil, err
+	}
+	if err := validateGrantRequest(&req); err != nil {
+		return nil, err
+	}
+	audience := s.audience(ctx, principal, id)
+	doc, err := s.repo.Documents.RevokeGrant(ctx, s.actingUserID(ctx, principal, id), id, req)
+	if err != nil {
+		return nil, err
+	}
+	return doc, s.invalidateAccess(ctx, id, doc.Public, audience)
+}
+
+// actingUserID returns the user whose access is checked for a call on the
+// document: its owner for principals managing every document, the principal
+// itself otherwise.
+func (s *DocumentService) actingUserID(ctx context.Context, principal *model.Principal, id string) int {
+	if principal.Can(model.PermDocsManage) {
+		if ownerID, err := s.repo.Documents.GetOwner(ctx, id); err == nil {
+			return ownerID
+		}
+	}
+	return principal.UserID
+}
+
+func (s *DocumentService) GetVersions(ctx context.Context, principal *model.Principal, id string) ([]*model.DocumentVersion, error) {
+	if err := authorize(principal, model.PermDocsRead); err != nil {
+		return nil, err
+	}
+	return s.repo.Documents.GetVersions(ctx, s.actingUserID(ctx, principal, id), id)
+}
+
+func (s *DocumentService) GetVersion(ctx context.Context, principal *model.Principal, id string, version int) (*model.DocumentVersion, io.ReadCloser, error) {
+	if err := authorize(principal, model.PermDocsRead); err != nil {
+		return nil, nil, err
+	}
+	return s.repo.Documents.GetVersion(ctx, s.actingUserID(ctx, principal, id), id, version)
+}
+
+func (s *DocumentService) RestoreVersion(ctx context.Context, principal *model.Principal, id string, version int) (*model.Document, error) {
+	if err := authorize(principal, model.PermDocsWrite); err != nil {
+		return nil, err
+	}
+	doc, err := s.repo.Documents.RestoreVersion(ctx, s.actingUserID(ctx, principal, id), id, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.invalidate(ctx, id, doc.Public, s.audience(ctx, principal, id)); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (s *DocumentService) Diff(ctx context.Context, principal *model.Principal, id string, from, to int) (*model.DocumentDiff, error) {
+	if err := authorize(principal, model.PermDocsRead); err != nil {
+		return nil, err
+	}
+	userID := s.actingUserID(ctx, principal, id)
+	fromVer, fromBody, err := s.repo.Documents.GetVersion(ctx, userID, id, from)
+	if err != nil {
+		return nil, err
+	}
+	defer fromBody.Close()
+	toVer, toBody, err := s.repo.Documents.GetVersion(ctx, userID, id, to)
+	if err != nil {
+		return nil, err
+	}
+	defer toBody.Close()
+	diff := &model.DocumentDiff{
+		From:    from,
+		To:      to,
+		Changed: fromVer.File != toVer.File || fromVer.Hash != toVer.Hash || fromVer.Hash == "",
+	}
+	if fromVer.File || toVer.File || !diff.Changed {
+		return diff, nil
+	}
+	fromData, err := readDiffBody(fromBody)
+	if err != nil {
+		return nil, err
+	}
+	toData, err := readDiffBody(toBody)
+	if err != nil {
+		return nil, err
+	}
+	diff.Changed = fromData != toData
+	if diff.Changed {
+		if diff.Lines, err = diffLines(fromData, toData); err != nil {
+			return nil, err
+		}
+	}
+	return diff, nil
+}
+
+func compress(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns a seekable body, so that ranges can be served from it.
+func decompress(data []byte) (io.ReadCloser, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return contentBody{bytes.NewReader(body)}, nil
+}
+
+type contentBody struct {
+	*bytes.Reader
+}
+
+func (contentBody) Close() error {
 	return nil
 }
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lavatee/astraltest/internal/apperror"
+	"github.com/lavatee/astraltest/internal/model"
+	"github.com/lavatee/astraltest/internal/repository"
+)
+
+// fakeDocuments serves documents from memory. Like the repository before
+// access was checked there, GetFileData returns the body to anyone, so the
+// tests show that the service does not rely on it.
+type fakeDocuments struct {
+	repository.Documents
+	docs   map[string]*model.Document
+	acls   map[string]*model.DocumentACL
+	bodies map[string]string
+	reads  map[int]int
+}
+
+func (f *fakeDocuments) GetMeta(ctx context.Context, id string) (*model.Document, error) {
+	doc, ok := f.docs[id]
+	if !ok {
+		return nil, repository.ErrDocumentNotFound
+	}
+	copied := *doc
+	return &copied, nil
+}
+
+func (f *fakeDocuments) GetACL(ctx context.Context, id string) (*model.DocumentACL, error) {
+	acl, ok := f.acls[id]
+	if !ok {
+		return nil, repository.ErrDocumentNotFound
+	}
+	copied := *acl
+	return &copied, nil
+}
+
+func (f *fakeDocuments) GetFileData(ctx context.Context, userID int, id string) (io.ReadCloser, error) {
+	f.reads[userID]++
+	return io.NopCloser(strings.NewReader(f.bodies[id])), nil
+}
+
+func (f *fakeDocuments) GetAudience(ctx context.Context, id string) ([]int, error) {
+	acl := f.acls[id]
+	return append([]int{acl.OwnerID}, acl.Users...), nil
+}
+
+func (f *fakeDocuments) GetOwner(ctx context.Context, id string) (int, error) {
+	return f.acls[id].OwnerID, nil
+}
+
+func (f *fakeDocuments) RevokeGrant(ctx context.Context, userID int, id string, grant model.GrantRequest) (*model.Document, error) {
+	acl := f.acls[id]
+	acl.Users = nil
+	return f.GetMeta(ctx, id)
+}
+
+type fakeGroups struct {
+	repository.Groups
+	members map[int][]int
+}
+
+func (f *fakeGroups) GetUserGroupIDs(ctx context.Context, userID int) ([]int, error) {
+	return f.members[userID], nil
+}
+
+const (
+	ownerID    = 1
+	granteeID  = 2
+	memberID   = 3
+	strangerID = 4
+	groupID    = 10
+)
+
+func newTestDocumentService(t *testing.T, policy CachePolicy) (*DocumentService, *fakeDocuments) {
+	t.Helper()
+	docs := &fakeDocuments{
+		docs: map[string]*model.Document{
+			"doc": {ID: "doc", Name: "report", Version: 1, Size: 6, Created: time.Now()},
+		},
+		acls: map[string]*model.DocumentACL{
+			"doc": {OwnerID: ownerID, Users: []int{granteeID}, Groups: []int{groupID}},
+		},
+		bodies: map[string]string{"doc": "secret"},
+		reads:  make(map[int]int),
+	}
+	groups := &fakeGroups{members: map[int][]int{memberID: {groupID}}}
+	repo := &repository.Repository{Documents: docs, Groups: groups}
+	return NewDocumentService(repo, NewMemoryCache(MemoryCacheConfig{}), policy), docs
+}
+
+func principal(userID int, roles ...string) *model.Principal {
+	if len(roles) == 0 {
+		roles = []string{model.RoleEditor}
+	}
+	return &model.Principal{UserID: userID, Roles: roles}
+}
+
+func readDocument(t *testing.T, s *DocumentService, p *model.Principal) (string, error) {
+	t.Helper()
+	_, body, err := s.GetByID(context.Background(), p, "doc")
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("read body: %s", err)
+	}
+	return string(data), nil
+}
+
+var cachePolicies = map[string]CachePolicy{
+	"metadata": {},
+	"content":  {ContentMaxSize: 1024},
+}
+
+func TestGetByIDDeniesUnauthorizedOnMiss(t *testing.T) {
+	for name, policy := range cachePolicies {
+		t.Run(name, func(t *testing.T) {
+			s, docs := newTestDocumentService(t, policy)
+			_, err := readDocument(t, s, principal(strangerID))
+			if err == nil {
+				t.Fatal("stranger read the document")
+			}
+			if kind := apperror.KindOf(err); kind != apperror.NotFound {
+				t.Fatalf("stranger got %s, want not found", kind)
+			}
+			if docs.reads[strangerID] != 0 {
+				t.Fatal("body was loaded for the stranger")
+			}
+		})
+	}
+}
+
+func TestGetByIDDeniesUnauthorizedOnHit(t *testing.T) {
+	for name, policy := range cachePolicies {
+		t.Run(name, func(t *testing.T) {
+			s, docs := newTestDocumentService(t, policy)
+			for _, userID := range []int{ownerID, granteeID, memberID} {
+				body, err := readDocument(t, s, principal(userID))
+				if err != nil {
+					t.Fatalf("user %d: %s", userID, err)
+				}
+				if body != "secret" {
+					t.Fatalf("user %d got %q", userID, body)
+				}
+			}
+			if _, err := readDocument(t, s, principal(strangerID)); err == nil {
+				t.Fatal("stranger read the cached document")
+			}
+			if docs.reads[strangerID] != 0 {
+				t.Fatal("body was loaded for the stranger")
+			}
+		})
+	}
+}
+
+func TestGetByIDAllowsManagers(t *testing.T) {
+	s, docs := newTestDocumentService(t, CachePolicy{})
+	if _, err := readDocument(t, s, principal(strangerID, model.RoleAdmin)); err != nil {
+		t.Fatalf("admin: %s", err)
+	}
+	if docs.reads[ownerID] != 1 {
+		t.Fatal("admin did not read the body as the owner")
+	}
+}
+
+func TestGetByIDRequiresReadPermission(t *testing.T) {
+	s, _ := newTestDocumentService(t, CachePolicy{})
+	if _, err := readDocument(t, s, principal(ownerID, "unknown")); err == nil {
+		t.Fatal("principal without roles read the document")
+	}
+}
+
+func TestGetByIDDeniesRevokedGrantOnHit(t *testing.T) {
+	for name, policy := range cachePolicies {
+		t.Run(name, func(t *testing.T) {
+			s, _ := newTestDocumentService(t, policy)
+			if _, err := readDocument(t, s, principal(granteeID)); err != nil {
+				t.Fatalf("grantee: %s", err)
+			}
+			req := model.GrantRequest{Login: "grantee"}
+			if _, err := s.RevokeGrant(context.Background(), principal(ownerID), "doc", req); err != nil {
+				t.Fatalf("revoke: %s", err)
+			}
+			if _, err := readDocument(t, s, principal(granteeID)); err == nil {
+				t.Fatal("grantee read the document after the grant was revoked")
+			}
+		})
+	}
+}
+
+func TestGetByIDDeniesFormerGroupMemberOnHit(t *testing.T) {
+	s, _ := newTestDocumentService(t, CachePolicy{})
+	if _, err := readDocument(t, s, principal(memberID)); err != nil {
+		t.Fatalf("member: %s", err)
+	}
+	s.repo.Groups.(*fakeGroups).members[memberID] = nil
+	if err := s.invalidateMemberships(context.Background(), []int{memberID}); err != nil {
+		t.Fatalf("invalidate: %s", err)
+	}
+	if _, err := readDocument(t, s, principal(memberID)); err == nil {
+		t.Fatal("former member read the document")
+	}
+}
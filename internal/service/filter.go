@@ -0,0 +1,146 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lavatee/astraltest/internal/model"
+)
+
+var filterOps = map[model.FieldType][]model.FilterOp{
+	model.FieldString: {model.OpEq, model.OpNe, model.OpLt, model.OpLte, model.OpGt, model.OpGte, model.OpIn, model.OpLike},
+	model.FieldInt:    {model.OpEq, model.OpNe, model.OpLt, model.OpLte, model.OpGt, model.OpGte, model.OpIn},
+	model.FieldBool:   {model.OpEq, model.OpNe},
+	model.FieldTime:   {model.OpEq, model.OpNe, model.OpLt, model.OpLte, model.OpGt, model.OpGte},
+}
+
+// ParseFilter parses the listing filter language:
+//
+//	name:like:report*,mime:in:application/pdf|image/png,created:gte:2025-01-01,mime:is-null
+//
+// Conditions are separated by commas and joined with AND, "in" values are
+// separated by "|". Both separators can be escaped with a backslash.
+func ParseFilter(raw string) (model.Filter, error) {
+	var filter model.Filter
+	if strings.TrimSpace(raw) == "" {
+		return filter, nil
+	}
+	for _, part := range splitEscaped(raw, ',') {
+		fields := strings.SplitN(part, ":", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid filter condition %q, expected field:op:value", unescape(part))
+		}
+		value := ""
+		if len(fields) == 3 {
+			value = fields[2]
+		}
+		cond, err := parseCondition(fields[0], model.FilterOp(fields[1]), value)
+		if err != nil {
+			return nil, err
+		}
+		filter = append(filter, cond)
+	}
+	return filter, nil
+}
+
+// NewFilterCondition builds a single condition from an unescaped value.
+func NewFilterCondition(field string, op model.FilterOp, value string) (model.FilterCondition, error) {
+	return parseCondition(field, op, strings.ReplaceAll(value, `\`, `\\`))
+}
+
+// parseCondition validates a condition against the whitelist of document
+// fields and converts its value to the type of the field.
+func parseCondition(field string, op model.FilterOp, value string) (model.FilterCondition, error) {
+	cond := model.FilterCondition{Field: field, Op: op}
+	def, ok := model.DocumentFilterFields[field]
+	if !ok {
+		return cond, fmt.Errorf("unknown filter field %q", field)
+	}
+	if op == model.OpIsNull {
+		if !def.Nullable {
+			return cond, fmt.Errorf("field %q can not be null", field)
+		}
+		isNull := true
+		if value != "" {
+			var err error
+			if isNull, err = strconv.ParseBool(value); err != nil {
+				return cond, fmt.Errorf("invalid is-null value %q for field %q", value, field)
+			}
+		}
+		cond.Values = []interface{}{isNull}
+		return cond, nil
+	}
+	if !allowedOp(def.Type, op) {
+		return cond, fmt.Errorf("operator %q is not supported for field %q", op, field)
+	}
+	raw := []string{value}
+	if op == model.OpIn {
+		raw = splitEscaped(value, '|')
+	}
+	for _, r := range raw {
+		v, err := parseFilterValue(def.Type, unescape(r))
+		if err != nil {
+			return cond, fmt.Errorf("invalid value %q for field %q: %s", unescape(r), field, err.Error())
+		}
+		cond.Values = append(cond.Values, v)
+	}
+	return cond, nil
+}
+
+func allowedOp(fieldType model.FieldType, op model.FilterOp) bool {
+	for _, allowed := range filterOps[fieldType] {
+		if op == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func parseFilterValue(fieldType model.FieldType, value string) (interface{}, error) {
+	switch fieldType {
+	case model.FieldInt:
+		return strconv.ParseInt(value, 10, 64)
+	case model.FieldBool:
+		return strconv.ParseBool(value)
+	case model.FieldTime:
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		}
+		return time.Parse(time.DateOnly, value)
+	default:
+		return value, nil
+	}
+}
+
+// splitEscaped splits s by sep, keeping escape sequences in place so that
+// the parts can be split again before unescaping.
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
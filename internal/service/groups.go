@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+
+	"github.com/lavatee/astraltest/internal/model"
+	"github.com/lavatee/astraltest/internal/repository"
+)
+
+// GroupService manages groups of users that documents can be shared with.
+// Membership changes change what members see, so their listing caches are
+// dropped.
+type GroupService struct {
+	repo *repository.Repository
+	docs *DocumentService
+}
+
+func NewGroupService(repo *repository.Repository, docs *DocumentService) *GroupService {
+	return &GroupService{repo: repo, docs: docs}
+}
+
+func (s *GroupService) GetGroups(ctx context.Context, principal *model.Principal) ([]*model.Group, error) {
+	if err := authorize(principal, model.PermDocsRead); err != nil {
+		return nil, err
+	}
+	groups, err := s.repo.Groups.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if groups == nil {
+		groups = []*model.Group{}
+	}
+	return groups, nil
+}
+
+func (s *GroupService) GetGroup(ctx context.Context, principal *model.Principal, name string) (*model.Group, error) {
+	if err := authorize(principal, model.PermDocsRead); err != nil {
+		return nil, err
+	}
+	return s.repo.Groups.GetByName(ctx, name)
+}
+
+func (s *GroupService) CreateGroup(ctx context.Context, principal *model.Principal, req model.GroupRequest) (*model.Group, error) {
+	if err := authorize(principal, model.PermUsersManage); err != nil {
+		return nil, err
+	}
+	group := &model.Group{Name: req.Name, Members: req.Members}
+	if err := s.repo.Groups.Create(ctx, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (s *GroupService) DeleteGroup(ctx context.Context, principal *model.Principal, name string) error {
+	if err := authorize(principal, model.PermUsersManage); err != nil {
+		return err
+	}
+	members, documents, err := s.repo.Groups.Delete(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := s.docs.invalidateMemberships(ctx, members); err != nil {
+		return err
+	}
+	// The cached metadata and access lists of the documents still name the
+	// group.
+	if err := s.docs.invalidateDocuments(ctx, documents); err != nil {
+		return err
+	}
+	// Besides the members losing access, everyone who sees the documents
+	// shared with the group sees their grants change.
+	return s.docs.invalidateListings(ctx)
+}
+
+func (s *GroupService) AddGroupMember(ctx context.Context, principal *model.Principal, name, login string) error {
+	if err := authorize(principal, model.PermUsersManage); err != nil {
+		return err
+	}
+	userID, err := s.repo.Groups.AddMember(ctx, name, login)
+	if err != nil {
+		return err
+	}
+	return s.docs.invalidateMemberships(ctx, []int{userID})
+}
+
+func (s *GroupService) RemoveGroupMember(ctx context.Context, principal *model.Principal, name, login string) error {
+	if err := authorize(principal, model.PermUsersManage); err != nil {
+		return err
+	}
+	userID, err := s.repo.Groups.RemoveMember(ctx, name, login)
+	if err != nil {
+		return err
+	}
+	return s.docs.invalidateMemberships(ctx, []int{userID})
+}
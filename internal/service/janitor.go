@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lavatee/astraltest/internal/repository"
+	"github.com/sirupsen/logrus"
+)
+
+type JanitorConfig struct {
+	Enabled          bool
+	SessionsInterval time.Duration
+	OrphansInterval  time.Duration
+	OrphanGrace      time.Duration
+}
+
+type janitorJob struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) (int64, error)
+}
+
+// Janitor runs periodic clean-up jobs in the background. Every replica runs
+// a janitor, Postgres advisory locks make sure each job runs on one of them.
+type Janitor struct {
+	repo *repository.Repository
+	jobs []janitorJob
+	wg   sync.WaitGroup
+}
+
+func NewJanitor(repo *repository.Repository, config JanitorConfig) *Janitor {
+	if config.SessionsInterval <= 0 {
+		config.SessionsInterval = time.Hour
+	}
+	if config.OrphansInterval <= 0 {
+		config.OrphansInterval = 24 * time.Hour
+	}
+	if config.OrphanGrace <= 0 {
+		config.OrphanGrace = time.Hour
+	}
+	j := &Janitor{repo: repo}
+	if !config.Enabled {
+		return j
+	}
+	j.jobs = []janitorJob{
+		{name: "sessions", interval: config.SessionsInterval, run: repo.Maintenance.PurgeSessions},
+		{name: "orphans", interval: config.OrphansInterval, run: func(ctx context.Context) (int64, error) {
+			rows, err := repo.Maintenance.PurgeOrphanRows(ctx)
+			if err != nil {
+				return rows, err
+			}
+			blobs, err := repo.Maintenance.PurgeOrphanBlobs(ctx, config.OrphanGrace)
+			return rows + blobs, err
+		}},
+	}
+	return j
+}
+
+// Start runs every job right away and then on its interval until ctx is done.
+func (j *Janitor) Start(ctx context.Context) {
+	for _, job := range j.jobs {
+		j.wg.Add(1)
+		go func(job janitorJob) {
+			defer j.wg.Done()
+			ticker := time.NewTicker(job.interval)
+			defer ticker.Stop()
+			for {
+				j.runJob(ctx, job)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(job)
+	}
+}
+
+// Wait blocks until the jobs that are running have finished.
+func (j *Janitor) Wait() {
+	j.wg.Wait()
+}
+
+func (j *Janitor) runJob(ctx context.Context, job janitorJob) {
+	started := time.Now()
+	var removed int64
+	ran, err := j.repo.Maintenance.RunExclusive(ctx, job.name, job.interval, func(ctx context.Context) (int64, error) {
+		var err error
+		removed, err = job.run(ctx)
+		return removed, err
+	})
+	log := logrus.WithFields(logrus.Fields{
+		"job":      job.name,
+		"removed":  removed,
+		"duration": time.Since(started).String(),
+	})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Errorf("Janitor job failed: %s", err.Error())
+		}
+		return
+	}
+	if ran {
+		log.Info("Janitor job finished")
+	} else {
+		log.Debug("Janitor job skipped, it is run by another replica")
+	}
+}
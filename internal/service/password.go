@@ -0,0 +1,180 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// legacySalt was prepended (as bytes, not hashed) to the SHA-1 digest of
+	// the password by the first version of the service.
+	legacySalt = "2ru035c3x3w25"
+
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+var errUnknownHash = errors.New("unknown password hash format")
+
+type PasswordConfig struct {
+	Algorithm  string
+	Argon2     Argon2Config
+	BcryptCost int
+}
+
+type Argon2Config struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordHasher hashes passwords into PHC strings
+// ($argon2id$v=19$m=65536,t=3,p=2$salt$hash) or bcrypt hashes and verifies
+// every format ever stored in users.password_hash.
+type PasswordHasher struct {
+	config PasswordConfig
+	dummy  string
+}
+
+func NewPasswordHasher(config PasswordConfig) (*PasswordHasher, error) {
+	if config.Algorithm == "" {
+		config.Algorithm = AlgorithmArgon2id
+	}
+	if config.Argon2.Memory == 0 {
+		config.Argon2.Memory = 64 * 1024
+	}
+	if config.Argon2.Iterations == 0 {
+		config.Argon2.Iterations = 3
+	}
+	if config.Argon2.Parallelism == 0 {
+		config.Argon2.Parallelism = 2
+	}
+	if config.Argon2.SaltLength == 0 {
+		config.Argon2.SaltLength = 16
+	}
+	if config.Argon2.KeyLength == 0 {
+		config.Argon2.KeyLength = 32
+	}
+	if config.BcryptCost == 0 {
+		config.BcryptCost = bcrypt.DefaultCost
+	}
+	if config.Algorithm != AlgorithmArgon2id && config.Algorithm != AlgorithmBcrypt {
+		return nil, fmt.Errorf("unknown password hashing algorithm: %s", config.Algorithm)
+	}
+	if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("invalid bcrypt cost: %d", config.BcryptCost)
+	}
+	h := &PasswordHasher{config: config}
+	dummy, err := h.Hash("dummy password")
+	if err != nil {
+		return nil, err
+	}
+	h.dummy = dummy
+	return h, nil
+}
+
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.config.Algorithm == AlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.config.BcryptCost)
+		return string(hash), err
+	}
+	params := h.config.Argon2
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks the password against a stored hash in constant time.
+func (h *PasswordHasher) Verify(password, hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return false
+		}
+		actual := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(actual, key) == 1
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	default:
+		return subtle.ConstantTimeCompare([]byte(legacyHash(password)), []byte(hash)) == 1
+	}
+}
+
+// VerifyDummy burns the same time as a real verification, so that unknown
+// logins can not be told apart from wrong passwords by response time.
+func (h *PasswordHasher) VerifyDummy(password string) {
+	h.Verify(password, h.dummy)
+}
+
+// NeedsRehash reports whether the hash was produced by another algorithm or
+// with other cost parameters than the configured ones.
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		if h.config.Algorithm != AlgorithmArgon2id {
+			return true
+		}
+		params, salt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return true
+		}
+		want := h.config.Argon2
+		return params.Memory != want.Memory || params.Iterations != want.Iterations ||
+			params.Parallelism != want.Parallelism || uint32(len(salt)) != want.SaltLength ||
+			uint32(len(key)) != want.KeyLength
+	case strings.HasPrefix(hash, "$2"):
+		if h.config.Algorithm != AlgorithmBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.config.BcryptCost
+	default:
+		return true
+	}
+}
+
+func decodeArgon2(hash string) (Argon2Config, []byte, []byte, error) {
+	var params Argon2Config
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errUnknownHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, errUnknownHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errUnknownHash
+	}
+	return params, salt, key, nil
+}
+
+func legacyHash(password string) string {
+	sha := sha1.New()
+	sha.Write([]byte(password))
+	return fmt.Sprintf("%x", sha.Sum([]byte(legacySalt)))
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/lavatee/astraltest/internal/apperror"
+	"github.com/lavatee/astraltest/internal/model"
+)
+
+var (
+	ErrForbidden    = apperror.New(apperror.Forbidden, "Permission denied")
+	ErrInvalidRole  = apperror.New(apperror.Validation, "Unknown role")
+	ErrInvalidGrant = apperror.New(apperror.Validation, "Invalid grant")
+)
+
+// authorize fails with ErrForbidden unless one of the principal's roles
+// grants the permission.
+func authorize(principal *model.Principal, perm model.Permission) error {
+	if !principal.Can(perm) {
+		return fmt.Errorf("%w: %s required", ErrForbidden, perm)
+	}
+	return nil
+}
+
+func validateRoles(roles []string) error {
+	for _, role := range roles {
+		if _, ok := model.RolePermissions[role]; !ok {
+			return fmt.Errorf("%w: %s", ErrInvalidRole, role)
+		}
+	}
+	return nil
+}
+
+func validateGrants(users []model.UserGrant, groups []model.GroupGrant) error {
+	for _, grant := range users {
+		if !model.ValidGrantPermission(grant.Permission) {
+			return fmt.Errorf("%w: unknown permission %s", ErrInvalidGrant, grant.Permission)
+		}
+	}
+	for _, grant := range groups {
+		if !model.ValidGrantPermission(grant.Permission) {
+			return fmt.Errorf("%w: unknown permission %s", ErrInvalidGrant, grant.Permission)
+		}
+	}
+	return nil
+}
+
+// validateGrantRequest checks that the request targets either a user or a
+// group, defaulting the permission to read.
+func validateGrantRequest(req *model.GrantRequest) error {
+	if (req.Login == "") == (req.Group == "") {
+		return fmt.Errorf("%w: either login or group is required", ErrInvalidGrant)
+	}
+	if req.Permission == "" {
+		req.Permission = model.GrantRead
+	}
+	if !model.ValidGrantPermission(req.Permission) {
+		return fmt.Errorf("%w: unknown permission %s", ErrInvalidGrant, req.Permission)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
 )
 
 type RedisConfig struct {
@@ -15,7 +16,10 @@ type RedisConfig struct {
 	DB       int
 }
 
-func NewRedisClient(config RedisConfig) (*redis.Client, error) {
+// NewRedisClient connects to Redis. An unavailable Redis is not fatal: the
+// client reconnects on its own, and caches fall back to the database until
+// then.
+func NewRedisClient(config RedisConfig) *redis.Client {
 	client := redis.NewClient(&redis.Options{
 		Addr:     fmt.Sprintf("%s:%s", config.Host, config.Port),
 		Password: config.Password,
@@ -24,7 +28,7 @@ func NewRedisClient(config RedisConfig) (*redis.Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if _, err := client.Ping(ctx).Result(); err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+		logrus.Warnf("Failed to connect to Redis, continuing without cache until it is available: %s", err.Error())
 	}
-	return client, nil
+	return client
 }
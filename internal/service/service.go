@@ -2,41 +2,81 @@ package service
 
 import (
 	"context"
-	"mime/multipart"
+	"io"
 
 	"github.com/lavatee/astraltest/internal/model"
 	"github.com/lavatee/astraltest/internal/repository"
-	"github.com/redis/go-redis/v9"
 )
 
 type Auth interface {
 	Register(ctx context.Context, req model.RegisterRequest) (string, error)
-	Authenticate(ctx context.Context, req model.AuthRequest) (string, error)
-	ValidateToken(ctx context.Context, token string) (bool, error)
-	Logout(ctx context.Context, token string) error
+	Authenticate(ctx context.Context, req model.AuthRequest, client model.ClientInfo) (*model.Tokens, error)
+	Refresh(ctx context.Context, refreshToken string, client model.ClientInfo) (*model.Tokens, error)
+	ValidateToken(ctx context.Context, token string) (*model.Principal, error)
+	Logout(ctx context.Context, principal *model.Principal, token string) error
+	GetSessions(ctx context.Context, principal *model.Principal, currentToken string) ([]*model.Session, error)
+	RevokeSession(ctx context.Context, principal *model.Principal, id int) error
+	RevokeSessions(ctx context.Context, principal *model.Principal, exceptToken string) error
+	ChangePassword(ctx context.Context, principal *model.Principal, currentToken string, req model.PasswordChangeRequest) error
 }
 
 type Users interface {
 	GetUserByID(ctx context.Context, id int) (*model.User, error)
+	GetUsers(ctx context.Context, principal *model.Principal) ([]*model.User, error)
+	GetUser(ctx context.Context, principal *model.Principal, login string) (*model.User, error)
+	SetRoles(ctx context.Context, principal *model.Principal, login string, roles []string) (*model.User, error)
+	UpdateUser(ctx context.Context, principal *model.Principal, login string, patch model.UserPatch) (*model.User, error)
+	DeleteUser(ctx context.Context, principal *model.Principal, login string, deletion model.UserDeletion) error
+}
+
+type Groups interface {
+	GetGroups(ctx context.Context, principal *model.Principal) ([]*model.Group, error)
+	GetGroup(ctx context.Context, principal *model.Principal, name string) (*model.Group, error)
+	CreateGroup(ctx context.Context, principal *model.Principal, req model.GroupRequest) (*model.Group, error)
+	DeleteGroup(ctx context.Context, principal *model.Principal, name string) error
+	AddGroupMember(ctx context.Context, principal *model.Principal, name, login string) error
+	RemoveGroupMember(ctx context.Context, principal *model.Principal, name, login string) error
 }
 
 type Documents interface {
-	Upload(ctx context.Context, token, meta, jsonData string, file multipart.File, header *multipart.FileHeader, isFileLoaded bool) (*model.Document, error)
-	GetAll(ctx context.Context, token, login, key, value string, limit int) ([]*model.Document, error)
-	GetByID(ctx context.Context, token, id string) (*model.Document, []byte, error)
-	Delete(ctx context.Context, token, id string) error
+	Upload(ctx context.Context, principal *model.Principal, meta, jsonData string, file io.Reader, isFileLoaded bool) (*model.Document, error)
+	GetAll(ctx context.Context, principal *model.Principal, query model.DocumentQuery) (*model.DocumentPage, error)
+	GetByID(ctx context.Context, principal *model.Principal, id string) (*model.Document, io.ReadCloser, error)
+	Update(ctx context.Context, principal *model.Principal, id, meta, jsonData string, file io.Reader, isFileLoaded bool) (*model.Document, error)
+	GetVersions(ctx context.Context, principal *model.Principal, id string) ([]*model.DocumentVersion, error)
+	GetVersion(ctx context.Context, principal *model.Principal, id string, version int) (*model.DocumentVersion, io.ReadCloser, error)
+	RestoreVersion(ctx context.Context, principal *model.Principal, id string, version int) (*model.Document, error)
+	Diff(ctx context.Context, principal *model.Principal, id string, from, to int) (*model.DocumentDiff, error)
+	Delete(ctx context.Context, principal *model.Principal, id string) error
+	Patch(ctx context.Context, principal *model.Principal, id string, patch model.DocumentPatch) (*model.Document, error)
+	AddGrant(ctx context.Context, principal *model.Principal, id string, req model.GrantRequest) (*model.Document, error)
+	RevokeGrant(ctx context.Context, principal *model.Principal, id string, req model.GrantRequest) (*model.Document, error)
 }
 
 type Service struct {
 	Auth
 	Users
+	Groups
 	Documents
 }
 
-func NewService(repo *repository.Repository, adminToken string, cache *redis.Client) *Service {
-	return &Service{
-		Auth:      NewAuthService(repo, adminToken),
-		Users:     NewUserService(repo),
-		Documents: NewDocumentService(repo, cache),
+type Config struct {
+	AdminToken string
+	Password   PasswordConfig
+	Session    SessionConfig
+	Cache      CachePolicy
+}
+
+func NewService(repo *repository.Repository, config Config, cache Cache) (*Service, error) {
+	passwords, err := NewPasswordHasher(config.Password)
+	if err != nil {
+		return nil, err
 	}
+	docs := NewDocumentService(repo, cache, config.Cache)
+	return &Service{
+		Auth:      NewAuthService(repo, config.AdminToken, passwords, config.Session, cache),
+		Users:     NewUserService(repo, cache, docs),
+		Groups:    NewGroupService(repo, docs),
+		Documents: docs,
+	}, nil
 }
@@ -3,18 +3,166 @@ package service
 import (
 	"context"
 
+	"github.com/lavatee/astraltest/internal/apperror"
 	"github.com/lavatee/astraltest/internal/model"
 	"github.com/lavatee/astraltest/internal/repository"
 )
 
+var (
+	ErrSelfAction      = apperror.New(apperror.Validation, "Administrators can not disable or delete themselves")
+	ErrInvalidDeletion = apperror.New(apperror.Validation, "Documents must be deleted or transferred to another user")
+)
+
 type UserService struct {
-	repo *repository.Repository
+	repo  *repository.Repository
+	cache Cache
+	docs  *DocumentService
 }
 
-func NewUserService(repo *repository.Repository) *UserService {
-	return &UserService{repo: repo}
+func NewUserService(repo *repository.Repository, cache Cache, docs *DocumentService) *UserService {
+	return &UserService{repo: repo, cache: cache, docs: docs}
 }
 
 func (s *UserService) GetUserByID(ctx context.Context, id int) (*model.User, error) {
 	return s.repo.Users.GetByID(ctx, id)
 }
+
+func (s *UserService) GetUsers(ctx context.Context, principal *model.Principal) ([]*model.User, error) {
+	if err := authorize(principal, model.PermUsersManage); err != nil {
+		return nil, err
+	}
+	return s.repo.Users.GetAll(ctx)
+}
+
+func (s *UserService) GetUser(ctx context.Context, principal *model.Principal, login string) (*model.User, error) {
+	if err := authorize(principal, model.PermUsersManage); err != nil {
+		return nil, err
+	}
+	return s.repo.Users.GetByLogin(ctx, login)
+}
+
+func (s *UserService) SetRoles(ctx context.Context, principal *model.Principal, login string, roles []string) (*model.User, error) {
+	if roles == nil {
+		roles = []string{}
+	}
+	return s.UpdateUser(ctx, principal, login, model.UserPatch{Roles: roles})
+}
+
+// UpdateUser applies the patch. Disabling a user ends all of its sessions.
+func (s *UserService) UpdateUser(ctx context.Context, principal *model.Principal, login string, patch model.UserPatch) (*model.User, error) {
+	if err := authorize(principal, model.PermUsersManage); err != nil {
+		return nil, err
+	}
+	if err := validateRoles(patch.Roles); err != nil {
+		return nil, err
+	}
+	user, err := s.repo.Users.GetByLogin(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	if patch.Disabled != nil && *patch.Disabled && user.ID == principal.UserID {
+		return nil, ErrSelfAction
+	}
+	if patch.Roles != nil {
+		if err := s.repo.Users.SetRoles(ctx, user.ID, patch.Roles); err != nil {
+			return nil, err
+		}
+		user.Roles = patch.Roles
+		if err := s.evictPrincipals(ctx, user.ID); err != nil {
+			return nil, err
+		}
+	}
+	if patch.Disabled != nil && *patch.Disabled != user.Disabled {
+		if err := s.repo.Users.SetDisabled(ctx, user.ID, *patch.Disabled); err != nil {
+			return nil, err
+		}
+		user.Disabled = *patch.Disabled
+		if user.Disabled {
+			tokens, err := s.repo.Users.RevokeUserSessions(ctx, user.ID, "")
+			if err != nil {
+				return nil, err
+			}
+			if err := s.evictTokens(ctx, tokens); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return user, nil
+}
+
+// DeleteUser removes the user, deleting its documents or handing them over
+// to another user as requested.
+func (s *UserService) DeleteUser(ctx context.Context, principal *model.Principal, login string, deletion model.UserDeletion) error {
+	if err := authorize(principal, model.PermUsersManage); err != nil {
+		return err
+	}
+	user, err := s.repo.Users.GetByLogin(ctx, login)
+	if err != nil {
+		return err
+	}
+	if user.ID == principal.UserID {
+		return ErrSelfAction
+	}
+	ids, err := s.repo.Documents.GetOwnedIDs(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	var tokens []string
+	switch deletion.Documents {
+	case model.DocumentsTransfer:
+		target, err := s.repo.Users.GetByLogin(ctx, deletion.TransferTo)
+		if err != nil {
+			return err
+		}
+		if target.ID == user.ID {
+			return ErrInvalidDeletion
+		}
+		if tokens, err = s.repo.Users.Delete(ctx, user.ID, target.ID); err != nil {
+			return err
+		}
+		if err := s.docs.invalidateDocuments(ctx, ids); err != nil {
+			return err
+		}
+	case model.DocumentsDelete:
+		for _, id := range ids {
+			if err := s.docs.Delete(ctx, principal, id); err != nil {
+				return err
+			}
+		}
+		if tokens, err = s.repo.Users.Delete(ctx, user.ID, 0); err != nil {
+			return err
+		}
+	default:
+		return ErrInvalidDeletion
+	}
+	// Owners and grants of documents anyone may see have changed.
+	if err := s.docs.invalidateListings(ctx); err != nil {
+		return err
+	}
+	return s.evictTokens(ctx, tokens)
+}
+
+// evictPrincipals drops the cached principals of the user's sessions, so that
+// role changes apply to the next request instead of after session expiry.
+func (s *UserService) evictPrincipals(ctx context.Context, userID int) error {
+	sessions, err := s.repo.Users.GetSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+	tokens := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		tokens = append(tokens, session.Token)
+	}
+	return s.evictTokens(ctx, tokens)
+}
+
+func (s *UserService) evictTokens(ctx context.Context, tokens []string) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		keys = append(keys, "session:"+token)
+	}
+	return deleteStrict(ctx, s.cache, keys...)
+}
@@ -0,0 +1,9 @@
+DELETE FROM document_grants WHERE group_id IS NOT NULL;
+
+ALTER TABLE document_grants DROP CONSTRAINT IF EXISTS document_grants_document_id_group_id_key;
+ALTER TABLE document_grants DROP CONSTRAINT IF EXISTS document_grants_target_check;
+ALTER TABLE document_grants DROP COLUMN IF EXISTS group_id;
+ALTER TABLE document_grants ALTER COLUMN user_id SET NOT NULL;
+
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS groups;
\ No newline at end of file
@@ -0,0 +1,18 @@
+CREATE TABLE groups (
+    group_id SERIAL PRIMARY KEY,
+    name VARCHAR(50) UNIQUE NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE group_members (
+    group_id INTEGER NOT NULL REFERENCES groups(group_id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX group_members_user_id_idx ON group_members (user_id);
+
+ALTER TABLE document_grants ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE document_grants ADD COLUMN group_id INTEGER REFERENCES groups(group_id) ON DELETE CASCADE;
+ALTER TABLE document_grants ADD CONSTRAINT document_grants_target_check CHECK (num_nonnulls(user_id, group_id) = 1);
+ALTER TABLE document_grants ADD CONSTRAINT document_grants_document_id_group_id_key UNIQUE (document_id, group_id);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE document_grants DROP COLUMN IF EXISTS permission;
\ No newline at end of file
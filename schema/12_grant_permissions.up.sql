@@ -0,0 +1,2 @@
+ALTER TABLE document_grants ADD COLUMN permission VARCHAR(10) NOT NULL DEFAULT 'read'
+    CHECK (permission IN ('read', 'write', 'share', 'delete'));
\ No newline at end of file
@@ -0,0 +1,19 @@
+ALTER TABLE documents ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+
+CREATE TABLE document_versions (
+    document_id VARCHAR(36) NOT NULL REFERENCES documents(id),
+    version INTEGER NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    mime VARCHAR(100),
+    is_file BOOLEAN NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    data TEXT,
+    file_data BYTEA,
+    PRIMARY KEY (document_id, version)
+);
+
+INSERT INTO document_versions (document_id, version, name, mime, is_file, created_at, data, file_data)
+SELECT d.id, 1, d.name, d.mime, d.is_file, d.created_at, dd.data, df.data
+FROM documents d
+LEFT JOIN document_data dd ON dd.document_id = d.id
+LEFT JOIN document_files df ON df.document_id = d.id;
\ No newline at end of file
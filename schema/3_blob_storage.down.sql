@@ -0,0 +1,5 @@
+ALTER TABLE document_versions DROP COLUMN IF EXISTS size;
+ALTER TABLE document_versions DROP COLUMN IF EXISTS blob_key;
+
+ALTER TABLE document_files DROP COLUMN IF EXISTS size;
+ALTER TABLE document_files DROP COLUMN IF EXISTS blob_key;
\ No newline at end of file
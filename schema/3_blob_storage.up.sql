@@ -0,0 +1,6 @@
+ALTER TABLE document_files ALTER COLUMN data DROP NOT NULL;
+ALTER TABLE document_files ADD COLUMN blob_key VARCHAR(255);
+ALTER TABLE document_files ADD COLUMN size BIGINT;
+
+ALTER TABLE document_versions ADD COLUMN blob_key VARCHAR(255);
+ALTER TABLE document_versions ADD COLUMN size BIGINT;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE document_versions DROP COLUMN IF EXISTS hash;
+ALTER TABLE documents DROP COLUMN IF EXISTS hash;
+ALTER TABLE documents DROP COLUMN IF EXISTS size;
\ No newline at end of file
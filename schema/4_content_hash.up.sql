@@ -0,0 +1,11 @@
+ALTER TABLE documents ADD COLUMN size BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE documents ADD COLUMN hash VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE document_versions ADD COLUMN hash VARCHAR(64) NOT NULL DEFAULT '';
+
+UPDATE document_versions SET
+    size = COALESCE(octet_length(file_data), octet_length(convert_to(data, 'UTF8')), size),
+    hash = COALESCE(encode(sha256(COALESCE(file_data, convert_to(data, 'UTF8'))), 'hex'), '');
+
+UPDATE documents d SET size = COALESCE(v.size, 0), hash = v.hash
+FROM document_versions v
+WHERE v.document_id = d.id AND v.version = d.version;
\ No newline at end of file
@@ -0,0 +1,8 @@
+ALTER TABLE documents ADD COLUMN updated_at TIMESTAMP;
+
+UPDATE documents d SET updated_at = COALESCE(
+    (SELECT v.created_at FROM document_versions v WHERE v.document_id = d.id AND v.version = d.version),
+    d.created_at
+);
+
+ALTER TABLE documents ALTER COLUMN updated_at SET NOT NULL;
\ No newline at end of file
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS refresh_tokens;
+
+DROP INDEX IF EXISTS sessions_family_id_idx;
+ALTER TABLE sessions DROP COLUMN IF EXISTS family_id;
\ No newline at end of file
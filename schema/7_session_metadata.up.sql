@@ -0,0 +1,6 @@
+ALTER TABLE sessions ADD COLUMN ip VARCHAR(45);
+ALTER TABLE sessions ADD COLUMN user_agent VARCHAR(512);
+ALTER TABLE sessions ADD COLUMN last_used_at TIMESTAMP;
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
\ No newline at end of file
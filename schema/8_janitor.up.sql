@@ -0,0 +1,12 @@
+CREATE TABLE janitor_runs (
+    job VARCHAR(50) PRIMARY KEY,
+    started_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP NOT NULL,
+    duration_ms BIGINT NOT NULL DEFAULT 0,
+    removed BIGINT NOT NULL DEFAULT 0,
+    runs BIGINT NOT NULL DEFAULT 0,
+    failures BIGINT NOT NULL DEFAULT 0,
+    last_error TEXT
+);
+
+CREATE INDEX sessions_expires_at_idx ON sessions (expires_at);
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS user_roles;
\ No newline at end of file
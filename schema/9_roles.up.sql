@@ -0,0 +1,7 @@
+CREATE TABLE user_roles (
+    user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    role VARCHAR(20) NOT NULL CHECK (role IN ('admin', 'editor', 'reader')),
+    PRIMARY KEY (user_id, role)
+);
+
+INSERT INTO user_roles (user_id, role) SELECT user_id, 'editor' FROM users;
\ No newline at end of file